@@ -0,0 +1,247 @@
+package maildir
+
+import (
+	"container/list"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// A MessageCache caches the parsed headers of the messages of a Dir. Entries
+// are evicted in least recently used order once their total size exceeds the
+// limit given to WithMessageCache.
+//
+// Entries are keyed by message key and modification time of the message file,
+// so a cached header is ignored as soon as the file is modified. Flag changes
+// don't modify the file and so don't invalidate the cache.
+//
+// A MessageCache is safe for concurrent use.
+type MessageCache struct {
+	d        Dir
+	maxBytes int
+
+	mu      sync.Mutex
+	size    int
+	lru     *list.List // of *cacheEntry, most recently used first
+	entries map[string]*list.Element
+}
+
+type cacheEntry struct {
+	key     string
+	modTime time.Time
+	header  mail.Header
+	size    int
+}
+
+// WithMessageCache returns a MessageCache for d holding at most maxBytes worth
+// of headers.
+func (d Dir) WithMessageCache(maxBytes int) *MessageCache {
+	return &MessageCache{
+		d:        d,
+		maxBytes: maxBytes,
+		lru:      list.New(),
+		entries:  make(map[string]*list.Element),
+	}
+}
+
+// Header returns the header of a message by key, reading it from disk only if
+// it isn't cached or the message file has been modified since.
+func (c *MessageCache) Header(key string) (mail.Header, error) {
+	filename, err := c.d.Filename(key)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := os.Stat(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	if elem, ok := c.entries[key]; ok {
+		entry := elem.Value.(*cacheEntry)
+		if entry.modTime.Equal(fi.ModTime()) {
+			c.lru.MoveToFront(elem)
+			c.mu.Unlock()
+			return entry.header, nil
+		}
+		c.remove(elem)
+	}
+	c.mu.Unlock()
+
+	header, err := c.d.Header(key)
+	if err != nil {
+		return nil, err
+	}
+
+	entry := &cacheEntry{
+		key:     key,
+		modTime: fi.ModTime(),
+		header:  header,
+		size:    headerSize(header),
+	}
+	if entry.size > c.maxBytes {
+		return header, nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.entries[key]; ok {
+		c.remove(elem)
+	}
+	c.entries[key] = c.lru.PushFront(entry)
+	c.size += entry.size
+	for c.size > c.maxBytes {
+		c.remove(c.lru.Back())
+	}
+	return header, nil
+}
+
+// Invalidate removes the message with the given key from the cache.
+func (c *MessageCache) Invalidate(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.entries[key]; ok {
+		c.remove(elem)
+	}
+}
+
+// remove drops an element from the cache. c.mu must be held.
+func (c *MessageCache) remove(elem *list.Element) {
+	entry := c.lru.Remove(elem).(*cacheEntry)
+	delete(c.entries, entry.key)
+	c.size -= entry.size
+}
+
+// headerSize returns an estimation of the memory used by a header.
+func headerSize(h mail.Header) int {
+	n := 0
+	for k, vs := range h {
+		for _, v := range vs {
+			n += len(k) + len(v)
+		}
+	}
+	return n
+}
+
+// A FolderCache caches the Maildir++ folders of a Dir resolved by name, so
+// that repeatedly opening the same folders, e.g. in an IMAP server, doesn't
+// hit the filesystem. Folders created or removed through the FolderCache
+// update the cache; other changes are only noticed after Invalidate.
+//
+// A FolderCache is safe for concurrent use.
+type FolderCache struct {
+	d Dir
+
+	mu      sync.Mutex
+	folders map[string]Dir // by folder name
+}
+
+// WithFolderCache returns a FolderCache for the folders under d.
+func (d Dir) WithFolderCache() *FolderCache {
+	return &FolderCache{d: d, folders: make(map[string]Dir)}
+}
+
+// OpenFolder works like Dir.OpenFolder, but returns the cached folder if it
+// has already been opened.
+func (c *FolderCache) OpenFolder(name string) (Dir, error) {
+	c.mu.Lock()
+	folder, ok := c.folders[name]
+	c.mu.Unlock()
+	if ok {
+		return folder, nil
+	}
+
+	folder, err := c.d.OpenFolder(name)
+	if err != nil {
+		return "", err
+	}
+	c.mu.Lock()
+	c.folders[name] = folder
+	c.mu.Unlock()
+	return folder, nil
+}
+
+// CreateFolder creates the Maildir++ folder with the given name, and caches
+// it.
+func (c *FolderCache) CreateFolder(name string) (Dir, error) {
+	folder, err := c.d.CreateFolder(name)
+	if err != nil {
+		return "", err
+	}
+	c.mu.Lock()
+	c.folders[name] = folder
+	c.mu.Unlock()
+	return folder, nil
+}
+
+// RemoveFolder removes the Maildir++ folder with the given name and all its
+// messages, and drops it from the cache. INBOX can't be removed.
+func (c *FolderCache) RemoveFolder(name string) error {
+	err := c.d.RemoveFolder(name)
+	c.Invalidate(name)
+	return err
+}
+
+// Invalidate removes the folder with the given name from the cache, e.g.
+// after it has been removed by another process.
+func (c *FolderCache) Invalidate(name string) {
+	c.mu.Lock()
+	delete(c.folders, name)
+	c.mu.Unlock()
+}
+
+// A KeyIndex maps the keys of the messages in cur to their paths, reading the
+// directory once instead of on each lookup, e.g. to look up many keys of a
+// large Maildir. The index is built on the first lookup and rebuilt by
+// Refresh. A key missing from the index, or whose file has been renamed,
+// triggers a single Refresh, so that flag changes and new messages are
+// picked up.
+//
+// A KeyIndex is safe for concurrent use.
+type KeyIndex struct {
+	d Dir
+
+	mu    sync.Mutex
+	names map[string][]string // by key, nil until the first Refresh
+}
+
+// WithKeyIndex returns a KeyIndex for the messages in cur of d.
+func (d Dir) WithKeyIndex() *KeyIndex {
+	return &KeyIndex{d: d}
+}
+
+// Refresh rebuilds the index from the content of cur.
+func (x *KeyIndex) Refresh() error {
+	names, err := readdirnames(filepath.Join(string(x.d), "cur"))
+	if err != nil {
+		return err
+	}
+	matches := matchKeys(names)
+	x.mu.Lock()
+	x.names = matches
+	x.mu.Unlock()
+	return nil
+}
+
+// Filename works like Dir.Filename, but looks the key up in the index.
+func (x *KeyIndex) Filename(key string) (string, error) {
+	key = trimInfo(key)
+	for refreshed := false; ; refreshed = true {
+		x.mu.Lock()
+		names := x.names[key]
+		x.mu.Unlock()
+		if len(names) == 1 {
+			path := filepath.Join(string(x.d), "cur", names[0])
+			if _, err := os.Stat(path); err == nil || refreshed {
+				return path, nil
+			}
+		} else if refreshed {
+			return "", &KeyError{key, len(names)}
+		}
+		if err := x.Refresh(); err != nil {
+			return "", err
+		}
+	}
+}
@@ -0,0 +1,240 @@
+package maildir
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMessageCache(t *testing.T) {
+	t.Parallel()
+
+	d := Dir(t.TempDir())
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	key, w, err := d.Create(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte("Subject: first\r\n\r\nbody\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	path, err := d.Filename(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := d.WithMessageCache(1024)
+	h, err := c.Header(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := h.Get("Subject"); s != "first" {
+		t.Fatalf("Subject = %q, want %q", s, "first")
+	}
+
+	// rewrite the file but keep its mtime: the cached header must be used
+	if err := ioutil.WriteFile(path, []byte("Subject: second\r\n\r\nbody\r\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, fi.ModTime(), fi.ModTime()); err != nil {
+		t.Fatal(err)
+	}
+	h, err = c.Header(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := h.Get("Subject"); s != "first" {
+		t.Errorf("Subject = %q, want cached %q", s, "first")
+	}
+
+	// a new mtime invalidates the entry
+	later := fi.ModTime().Add(time.Minute)
+	if err := os.Chtimes(path, later, later); err != nil {
+		t.Fatal(err)
+	}
+	h, err = c.Header(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := h.Get("Subject"); s != "second" {
+		t.Errorf("Subject = %q, want %q", s, "second")
+	}
+}
+
+func TestMessageCache_Eviction(t *testing.T) {
+	t.Parallel()
+
+	d := Dir(t.TempDir())
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	var keys []string
+	for i := 0; i < 3; i++ {
+		key, err := d.Deliver(strings.NewReader("Subject: 0123456789\r\n\r\n"), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, key)
+	}
+	if _, err := d.Unseen(); err != nil {
+		t.Fatal(err)
+	}
+
+	// each header is 17 bytes long, only two fit
+	c := d.WithMessageCache(40)
+	for _, key := range keys {
+		if _, err := c.Header(key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, ok := c.entries[keys[0]]; ok {
+		t.Error("least recently used entry was not evicted")
+	}
+	if c.size > 40 {
+		t.Errorf("cache holds %v bytes, want at most 40", c.size)
+	}
+}
+
+func TestFolderCache(t *testing.T) {
+	t.Parallel()
+
+	d := Dir(t.TempDir())
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+	c := d.WithFolderCache()
+
+	created, err := c.CreateFolder("Work")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		folder, err := c.OpenFolder("Work")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if folder != created {
+			t.Errorf("FolderCache.OpenFolder() = %q, want %q", folder, created)
+		}
+	}
+	if folder, err := c.OpenFolder("INBOX"); err != nil {
+		t.Fatal(err)
+	} else if folder != d {
+		t.Errorf("FolderCache.OpenFolder(%q) = %q, want %q", "INBOX", folder, d)
+	}
+
+	if err := c.RemoveFolder("Work"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.OpenFolder("Work"); !os.IsNotExist(err) {
+		t.Errorf("FolderCache.OpenFolder() after RemoveFolder() = %v, want a not exist error", err)
+	}
+	if err := c.RemoveFolder("inbox"); err == nil {
+		t.Error("FolderCache.RemoveFolder(INBOX) succeeded")
+	}
+	if _, err := os.Stat(filepath.Join(string(d), "cur")); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestKeyIndex(t *testing.T) {
+	d := Dir(t.TempDir())
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+	var keys []string
+	for i := 0; i < 3; i++ {
+		key, err := d.Deliver(strings.NewReader("Subject: hello\r\n\r\n"), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, key)
+	}
+	if _, err := d.Unseen(); err != nil {
+		t.Fatal(err)
+	}
+
+	scans := 0
+	testHookReaddir = func(dir string) {
+		if dir == filepath.Join(string(d), "cur") {
+			scans++
+		}
+	}
+	defer func() {
+		testHookReaddir = nil
+	}()
+
+	x := d.WithKeyIndex()
+	for _, key := range keys {
+		path, err := x.Filename(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want, _ := d.Filename(key); path != want {
+			t.Errorf("KeyIndex.Filename(%q) = %q, want %q", key, path, want)
+		}
+	}
+	if scans != 1 {
+		t.Errorf("cur scanned %d times, want 1", scans)
+	}
+
+	// renamed files are picked up by a single refresh
+	if err := d.SetFlags(keys[0], []Flag{FlagSeen}); err != nil {
+		t.Fatal(err)
+	}
+	path, err := x.Filename(keys[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := filepath.Join(string(d), "cur", keys[0]+string(Separator)+"2,S"); path != want {
+		t.Errorf("KeyIndex.Filename() after SetFlags = %q, want %q", path, want)
+	}
+	if scans != 2 {
+		t.Errorf("cur scanned %d times, want 2", scans)
+	}
+
+	var keyErr *KeyError
+	if _, err := x.Filename("1600000000.M1.missing"); !errors.As(err, &keyErr) || keyErr.N != 0 {
+		t.Errorf("KeyIndex.Filename() of a missing key = %v, want a *KeyError", err)
+	}
+}
+
+func TestDir_Filenames(t *testing.T) {
+	t.Parallel()
+
+	d := Dir(t.TempDir())
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+	key, err := d.Deliver(strings.NewReader("Subject: hello\r\n\r\n"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Unseen(); err != nil {
+		t.Fatal(err)
+	}
+	// a glob metacharacter in a key must not match other messages
+	star := key[:len(key)-1] + "*"
+	paths, errs := d.Filenames([]string{key, star})
+	if want, _ := d.Filename(key); paths[key] != want {
+		t.Errorf("Dir.Filenames()[%q] = %q, want %q", key, paths[key], want)
+	}
+	if _, ok := paths[star]; ok || errs[star] == nil {
+		t.Errorf("Dir.Filenames() resolved %q", star)
+	}
+}
@@ -0,0 +1,244 @@
+package maildir
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// A ProblemKind is a kind of problem found by Dir.Check.
+type ProblemKind int
+
+const (
+	// ProblemStaleTmp is a file left in tmp for more than 36 hours, e.g. by
+	// an interrupted delivery. It is removed by repairs.
+	ProblemStaleTmp ProblemKind = iota + 1
+	// ProblemDuplicateKey is a message sharing its key with another message
+	// of new or cur. It is given a new key, with the S= size field, by
+	// repairs.
+	ProblemDuplicateKey
+	// ProblemBadInfo is a message of cur without a valid info section. Its
+	// info section is replaced with "2," by repairs, which clears its flags.
+	ProblemBadInfo
+	// ProblemMissingSize is a message whose key lacks the S= field holding
+	// its size. It is only reported, since fixing it would change the key.
+	ProblemMissingSize
+	// ProblemPermissions is a message file which isn't readable by its owner,
+	// or which is writable by other users. Repairs make it readable by its
+	// owner, and writable by its owner only.
+	ProblemPermissions
+)
+
+func (k ProblemKind) String() string {
+	switch k {
+	case ProblemStaleTmp:
+		return "stale tmp file"
+	case ProblemDuplicateKey:
+		return "duplicate key"
+	case ProblemBadInfo:
+		return "bad info section"
+	case ProblemMissingSize:
+		return "missing size"
+	case ProblemPermissions:
+		return "wrong permissions"
+	}
+	return "unknown problem"
+}
+
+// A Problem is an inconsistency found by Dir.Check.
+type Problem struct {
+	Kind     ProblemKind
+	Path     string // the path of the offending file
+	Key      string // the key of the message, unset for ProblemStaleTmp
+	Repaired bool   // whether the problem has been repaired
+}
+
+// CheckOptions contains optional parameters for Dir.Check. A nil
+// *CheckOptions is equivalent to the zero value.
+type CheckOptions struct {
+	// Repair fixes the problems which can be fixed, see ProblemKind. The
+	// Maildir must not be accessed by other programs while it is repaired.
+	Repair bool
+
+	// Folders also checks all the Maildir++ folders of the Maildir.
+	Folders bool
+}
+
+// staleTmpAge is the age after which a file of tmp is considered abandoned,
+// as per the Maildir specification.
+const staleTmpAge = 36 * time.Hour
+
+// Check scans tmp, new and cur for problems, e.g. to validate a Maildir
+// before and after copying it, and returns them. Problems are returned in the
+// order they are found, tmp first.
+//
+// If an error occurs, the problems found so far are returned along with the
+// error.
+func (d Dir) Check(opts *CheckOptions) ([]Problem, error) {
+	if opts == nil {
+		opts = new(CheckOptions)
+	}
+	problems, err := d.check(opts.Repair, nil)
+	if err != nil || !opts.Folders {
+		return problems, err
+	}
+	folders, err := d.Folders()
+	if err != nil {
+		return problems, err
+	}
+	for _, name := range folders {
+		folder, err := d.Folder(name)
+		if err != nil {
+			return problems, err
+		}
+		if problems, err = folder.check(opts.Repair, problems); err != nil {
+			return problems, err
+		}
+	}
+	return problems, nil
+}
+
+// check appends the problems of d to problems.
+func (d Dir) check(repair bool, problems []Problem) ([]Problem, error) {
+	tmp := filepath.Join(string(d), "tmp")
+	names, err := readdirnames(tmp)
+	if err != nil {
+		return problems, err
+	}
+	sort.Strings(names)
+	now := time.Now()
+	for _, n := range names {
+		path := filepath.Join(tmp, n)
+		fi, err := os.Lstat(path)
+		if err != nil || now.Sub(fi.ModTime()) <= staleTmpAge {
+			continue
+		}
+		p := Problem{Kind: ProblemStaleTmp, Path: path}
+		if repair {
+			if err := os.Remove(path); err != nil {
+				return append(problems, p), err
+			}
+			p.Repaired = true
+		}
+		problems = append(problems, p)
+	}
+
+	seen := make(map[string]bool)
+	for _, sub := range []string{"new", "cur"} {
+		dir := filepath.Join(string(d), sub)
+		names, err := readdirnames(dir)
+		if err != nil {
+			return problems, err
+		}
+		sort.Strings(names)
+		for _, n := range names {
+			if n[0] == '.' {
+				continue
+			}
+			if problems, err = d.checkMessage(dir, n, seen, repair, problems); err != nil {
+				return problems, err
+			}
+		}
+	}
+	return problems, nil
+}
+
+// renameNoReplace renames oldpath to newpath, failing with an error satisfying
+// os.IsExist instead of replacing newpath if it exists.
+func renameNoReplace(oldpath, newpath string) error {
+	if err := os.Link(oldpath, newpath); err != nil {
+		return err
+	}
+	return os.Remove(oldpath)
+}
+
+// checkMessage appends the problems of the message file name of dir to
+// problems. seen holds the keys of the messages checked so far.
+func (d Dir) checkMessage(dir, name string, seen map[string]bool, repair bool, problems []Problem) ([]Problem, error) {
+	path := filepath.Join(dir, name)
+	fi, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return problems, nil
+	} else if err != nil {
+		return problems, err
+	}
+	if !fi.Mode().IsRegular() {
+		return problems, nil
+	}
+	key, err := parseKey(name)
+	if err != nil {
+		return problems, nil
+	}
+	info := ""
+	if name != key {
+		info = name[len(key)+len(string(Separator)):]
+	}
+
+	// the index in problems of the ProblemBadInfo left to the duplicate key
+	// repair
+	badInfo := -1
+	if filepath.Base(dir) == "cur" {
+		var flagErr *FlagError
+		if _, err := parseFlags(name); err != nil && !(errors.As(err, &flagErr) && flagErr.Experimental) {
+			p := Problem{Kind: ProblemBadInfo, Path: path, Key: key}
+			if repair {
+				info = "2,"
+				newpath := filepath.Join(dir, key+string(Separator)+info)
+				err := renameNoReplace(path, newpath)
+				if os.IsExist(err) {
+					// another message has the repaired name: this one is
+					// given a fresh key below
+					badInfo = len(problems)
+				} else if err != nil {
+					return append(problems, p), err
+				} else {
+					path, p.Repaired = newpath, true
+				}
+			}
+			problems = append(problems, p)
+		}
+	}
+
+	if seen[key] || badInfo >= 0 {
+		p := Problem{Kind: ProblemDuplicateKey, Path: path, Key: key}
+		if repair {
+			fresh, err := newKey()
+			if err != nil {
+				return append(problems, p), err
+			}
+			fresh += ",S=" + strconv.FormatInt(fi.Size(), 10)
+			newpath := filepath.Join(dir, fresh)
+			if info != "" {
+				newpath += string(Separator) + info
+			}
+			if err := renameNoReplace(path, newpath); err != nil {
+				return append(problems, p), err
+			}
+			path, key, p.Repaired = newpath, fresh, true
+			if badInfo >= 0 {
+				problems[badInfo].Repaired = true
+			}
+		}
+		problems = append(problems, p)
+	}
+	seen[key] = true
+
+	if _, ok := keySize(key); !ok {
+		problems = append(problems, Problem{Kind: ProblemMissingSize, Path: path, Key: key})
+	}
+
+	if mode := fi.Mode().Perm(); mode&0400 == 0 || mode&0022 != 0 {
+		p := Problem{Kind: ProblemPermissions, Path: path, Key: key}
+		if repair {
+			if err := os.Chmod(path, mode&^0022|0400); err != nil {
+				return append(problems, p), err
+			}
+			p.Repaired = true
+		}
+		problems = append(problems, p)
+	}
+	return problems, nil
+}
@@ -0,0 +1,163 @@
+package maildir
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDir_Check(t *testing.T) {
+	t.Parallel()
+
+	d := Dir(t.TempDir())
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+	work, err := d.CreateFolder("Work")
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := []struct {
+		dir  Dir
+		path string
+		mode os.FileMode
+	}{
+		{d, "tmp/1600000000.M1.host", 0600},
+		{d, "tmp/1600000000.M2.host", 0600},
+		{d, "new/1600000000.M3.host,S=5", 0600},
+		{d, "cur/1600000000.M3.host,S=5:2,S", 0600},
+		{d, "cur/1600000000.M4.host,S=5:2", 0600},
+		{d, "cur/1600000000.M5.host:2,S", 0600},
+		{d, "cur/1600000000.M6.host,S=5:2,RS", 0666},
+		{work, "cur/1600000000.M7.host,S=5:2,S", 0644},
+	}
+	for _, f := range files {
+		path := filepath.Join(string(f.dir), f.path)
+		if err := ioutil.WriteFile(path, []byte("hello"), f.mode); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chmod(path, f.mode); err != nil {
+			t.Fatal(err)
+		}
+	}
+	old := time.Now().Add(-48 * time.Hour)
+	if err := os.Chtimes(filepath.Join(string(d), "tmp/1600000000.M1.host"), old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	problems, err := d.Check(&CheckOptions{Folders: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	type kindKey struct {
+		Kind ProblemKind
+		Key  string
+	}
+	kinds := func(problems []Problem) []kindKey {
+		var l []kindKey
+		for _, p := range problems {
+			l = append(l, kindKey{p.Kind, p.Key})
+		}
+		return l
+	}
+	want := []kindKey{
+		{ProblemStaleTmp, ""},
+		{ProblemDuplicateKey, "1600000000.M3.host,S=5"},
+		{ProblemBadInfo, "1600000000.M4.host,S=5"},
+		{ProblemMissingSize, "1600000000.M5.host"},
+		{ProblemPermissions, "1600000000.M6.host,S=5"},
+	}
+	if got := kinds(problems); !reflect.DeepEqual(got, want) {
+		t.Errorf("Dir.Check() = %v, want %v", got, want)
+	}
+	for _, p := range problems {
+		if p.Repaired {
+			t.Errorf("%v reported as repaired without Repair", p.Kind)
+		}
+	}
+
+	problems, err = d.Check(&CheckOptions{Repair: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := kinds(problems); !reflect.DeepEqual(got[:2], want[:2]) || !reflect.DeepEqual(got[3:], want[3:]) {
+		t.Errorf("Dir.Check() with Repair = %v, want %v", got, want)
+	}
+	for _, p := range problems {
+		if p.Repaired != (p.Kind != ProblemMissingSize) {
+			t.Errorf("%v repaired = %v", p.Kind, p.Repaired)
+		}
+	}
+
+	problems, err = d.Check(&CheckOptions{Folders: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := kinds(problems), want[3:4]; !reflect.DeepEqual(got, want) {
+		t.Errorf("Dir.Check() after repairing = %v, want %v", got, want)
+	}
+	if _, err := os.Stat(filepath.Join(string(d), "tmp/1600000000.M2.host")); err != nil {
+		t.Errorf("recent tmp file removed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(string(d), "cur/1600000000.M4.host,S=5:2,")); err != nil {
+		t.Errorf("bad info section not normalized: %v", err)
+	}
+}
+
+func TestDir_Check_repairCollision(t *testing.T) {
+	t.Parallel()
+
+	for _, garbage := range []string{"garbage", "!garbage"} {
+		d := Dir(t.TempDir())
+		if err := d.Init(); err != nil {
+			t.Fatal(err)
+		}
+		const key = "1600000000.M1.host"
+		cur := filepath.Join(string(d), "cur")
+		legit := filepath.Join(cur, key+string(Separator)+"2,")
+		if err := ioutil.WriteFile(legit, []byte("legit message"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(cur, key+string(Separator)+garbage), []byte("garbage"), 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		problems, err := d.Check(&CheckOptions{Repair: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var kinds []ProblemKind
+		for _, p := range problems {
+			if p.Kind == ProblemMissingSize {
+				continue
+			}
+			kinds = append(kinds, p.Kind)
+			if !p.Repaired {
+				t.Errorf("%v not repaired", p.Kind)
+			}
+		}
+		if want := []ProblemKind{ProblemBadInfo, ProblemDuplicateKey}; !reflect.DeepEqual(kinds, want) {
+			t.Errorf("Dir.Check() with Repair for %q = %v, want %v", garbage, kinds, want)
+		}
+		if got := cat(t, legit); got != "legit message" {
+			t.Errorf("legit message replaced with %q", got)
+		}
+		if n, err := d.TotalCount(); err != nil {
+			t.Fatal(err)
+		} else if n != 2 {
+			t.Errorf("Dir.TotalCount() = %v, want 2", n)
+		}
+		if problems, err := d.Check(nil); err != nil {
+			t.Fatal(err)
+		} else {
+			for _, p := range problems {
+				if p.Kind != ProblemMissingSize {
+					t.Errorf("problem left after repairing: %v", p.Kind)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package maildir
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// checksumFile is the name of the file, in the Maildir root, which stores the
+// checksums of messages delivered with DeliveryOptions.Checksum. It holds one
+// "<hex SHA-256> <key>" line per message.
+const checksumFile = "maildir-checksums"
+
+// appendChecksum records the checksum of a message. Lines are appended with a
+// single write so that concurrent deliveries don't interleave, under the lock
+// of the sidecar files so that they aren't lost by a concurrent rewrite.
+func (d Dir) appendChecksum(key string, sum []byte) error {
+	unlock, err := d.lockSidecars()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	f, err := os.OpenFile(filepath.Join(string(d), checksumFile),
+		os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(f, hex.EncodeToString(sum)+" "+key+"\n")
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// readChecksums returns the recorded checksums, by key.
+func (d Dir) readChecksums() (map[string]string, error) {
+	f, err := os.Open(filepath.Join(string(d), checksumFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	sums := make(map[string]string)
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("maildir: invalid %v line: %q", checksumFile, s.Text())
+		}
+		sums[fields[1]] = fields[0]
+	}
+	return sums, s.Err()
+}
+
+// VerifyChecksums checks the content of the messages delivered with
+// DeliveryOptions.Checksum against their recorded checksum, and returns the
+// keys of the messages which don't match. Messages which don't exist anymore
+// are ignored.
+func (d Dir) VerifyChecksums() ([]string, error) {
+	sums, err := d.readChecksums()
+	if err != nil {
+		return nil, err
+	}
+
+	var corrupted []string
+	for key, sum := range sums {
+		path, err := d.Filename(key)
+		var keyErr *KeyError
+		if errors.As(err, &keyErr) && keyErr.N == 0 {
+			// the message may not have been moved to cur yet
+			path = filepath.Join(string(d), "new", key)
+		} else if err != nil {
+			return corrupted, err
+		}
+
+		f, err := os.Open(path)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return corrupted, err
+		}
+		h := sha256.New()
+		_, err = io.Copy(h, f)
+		f.Close()
+		if err != nil {
+			return corrupted, err
+		}
+
+		want, err := hex.DecodeString(sum)
+		if err != nil || !bytes.Equal(h.Sum(nil), want) {
+			corrupted = append(corrupted, key)
+		}
+	}
+	return corrupted, nil
+}
@@ -0,0 +1,60 @@
+package maildir
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDir_VerifyChecksums(t *testing.T) {
+	t.Parallel()
+
+	d := Dir(t.TempDir())
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	opts := &DeliveryOptions{Checksum: true}
+	var keys []string
+	for i := 0; i < 3; i++ {
+		key, err := d.Deliver(strings.NewReader(fmt.Sprintf("message number %d", i)), opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, key)
+	}
+	// the last message stays in new
+	if err := os.Rename(filepath.Join(string(d), "new", keys[0]),
+		filepath.Join(string(d), "cur", keys[0]+string(Separator)+"2,")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(filepath.Join(string(d), "new", keys[1]),
+		filepath.Join(string(d), "cur", keys[1]+string(Separator)+"2,")); err != nil {
+		t.Fatal(err)
+	}
+
+	if corrupted, err := d.VerifyChecksums(); err != nil {
+		t.Fatal(err)
+	} else if len(corrupted) != 0 {
+		t.Errorf("Dir.VerifyChecksums() = %v, want none", corrupted)
+	}
+
+	path, err := d.Filename(keys[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, []byte("corrupted"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	corrupted, err := d.VerifyChecksums()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(corrupted) != 1 || corrupted[0] != keys[1] {
+		t.Errorf("Dir.VerifyChecksums() = %v, want [%v]", corrupted, keys[1])
+	}
+}
@@ -0,0 +1,206 @@
+package maildir
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"io"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DeduplicateByContent replaces the message files of d with identical contents
+// by hard links to a single file, and returns the number of bytes saved. The
+// filenames, and so the keys and flags of the messages, are preserved.
+//
+// Since the messages then share the same file, modifying the content of one of
+// them modifies all of them: this is meant for archives which are only
+// appended to, such as mailing list archives. Messages on different
+// filesystems are left untouched.
+func (d Dir) DeduplicateByContent() (saved int64, err error) {
+	// group the files by size first, to only hash the candidates
+	bySize := make(map[int64][]string)
+	for _, subdir := range []string{"new", "cur"} {
+		dir := filepath.Join(string(d), subdir)
+		f, err := os.Open(dir)
+		if err != nil {
+			return saved, err
+		}
+		fis, err := f.Readdir(0)
+		f.Close()
+		if err != nil {
+			return saved, err
+		}
+		for _, fi := range fis {
+			if fi.Mode().IsRegular() && fi.Name()[0] != '.' {
+				bySize[fi.Size()] = append(bySize[fi.Size()], filepath.Join(dir, fi.Name()))
+			}
+		}
+	}
+
+	for size, paths := range bySize {
+		if len(paths) < 2 {
+			continue
+		}
+		byHash := make(map[[sha256.Size]byte]string)
+		for _, path := range paths {
+			sum, err := hashFile(path)
+			if err != nil {
+				return saved, err
+			}
+			orig, ok := byHash[sum]
+			if !ok {
+				byHash[sum] = path
+				continue
+			}
+			linked, err := d.replaceWithLink(orig, path)
+			if err != nil {
+				return saved, err
+			}
+			if linked {
+				saved += size
+			}
+		}
+	}
+	return saved, nil
+}
+
+// hashFile returns the SHA-256 checksum of the file at path.
+func hashFile(path string) ([sha256.Size]byte, error) {
+	var sum [sha256.Size]byte
+	f, err := os.Open(path)
+	if err != nil {
+		return sum, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return sum, err
+	}
+	copy(sum[:], h.Sum(nil))
+	return sum, nil
+}
+
+// replaceWithLink atomically replaces the file dst by a hard link to src. It
+// reports false if the files already are the same or can't be linked.
+func (d Dir) replaceWithLink(src, dst string) (bool, error) {
+	srcInfo, err := os.Stat(src)
+	if err != nil {
+		return false, err
+	}
+	dstInfo, err := os.Stat(dst)
+	if err != nil {
+		return false, err
+	}
+	if os.SameFile(srcInfo, dstInfo) {
+		return false, nil
+	}
+
+	key, err := newKey()
+	if err != nil {
+		return false, err
+	}
+	tmppath := filepath.Join(string(d), "tmp", key)
+	if err := os.Link(src, tmppath); err != nil {
+		// e.g. the files are on different filesystems
+		return false, nil
+	}
+	if err := os.Rename(tmppath, dst); err != nil {
+		os.Remove(tmppath)
+		return false, err
+	}
+	return true, nil
+}
+
+// A DedupWindow delivers messages to a Dir, suppressing the messages whose
+// Message-ID has already been delivered recently, e.g. because of a mail loop
+// or a sender retrying a delivery. The Message-IDs are only kept in memory.
+//
+// A DedupWindow is safe for concurrent use.
+type DedupWindow struct {
+	d      Dir
+	window time.Duration
+	now    func() time.Time
+
+	mu   sync.Mutex
+	seen map[string]*dedupEntry // by Message-ID
+}
+
+type dedupEntry struct {
+	key  string // empty while the message is being delivered
+	time time.Time
+	done chan struct{} // closed once the delivery is over
+}
+
+// WithDedupWindow returns a DedupWindow for d, suppressing the messages whose
+// Message-ID has already been delivered less than window ago.
+func (d Dir) WithDedupWindow(window time.Duration) *DedupWindow {
+	return &DedupWindow{
+		d:      d,
+		window: window,
+		now:    time.Now,
+		seen:   make(map[string]*dedupEntry),
+	}
+}
+
+// Deliver delivers the message read from r like Dir.Deliver, unless a message
+// with the same Message-ID has been delivered within the window, in which case
+// the key of that message is returned instead. Messages without a Message-ID
+// are always delivered.
+func (w *DedupWindow) Deliver(r io.Reader, opts *DeliveryOptions) (string, error) {
+	br := bufio.NewReader(r)
+	header, sep, err := readRawHeader(br)
+	if err != nil {
+		return "", err
+	}
+	r = io.MultiReader(bytes.NewReader(header), bytes.NewReader(sep), br)
+
+	var id string
+	raw := append(append([]byte(nil), header...), lineEnding(header)...)
+	if msg, err := mail.ReadMessage(bytes.NewReader(raw)); err == nil {
+		id = strings.TrimSpace(msg.Header.Get("Message-Id"))
+	}
+	if id == "" {
+		return w.d.Deliver(r, opts)
+	}
+
+	for {
+		now := w.now()
+		w.mu.Lock()
+		for k, entry := range w.seen {
+			if entry.key != "" && now.Sub(entry.time) >= w.window {
+				delete(w.seen, k)
+			}
+		}
+		entry, ok := w.seen[id]
+		if !ok {
+			// reserve the Message-ID, so that concurrent deliveries of the
+			// same message wait for this one
+			entry = &dedupEntry{time: now, done: make(chan struct{})}
+			w.seen[id] = entry
+			w.mu.Unlock()
+
+			key, err := w.d.Deliver(r, opts)
+			w.mu.Lock()
+			if err != nil {
+				delete(w.seen, id)
+			} else {
+				entry.key = key
+			}
+			close(entry.done)
+			w.mu.Unlock()
+			return key, err
+		}
+		w.mu.Unlock()
+
+		<-entry.done
+		if entry.key != "" {
+			return entry.key, nil
+		}
+		// the reserving delivery failed, try again
+	}
+}
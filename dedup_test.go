@@ -0,0 +1,161 @@
+package maildir
+
+import (
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDir_DeduplicateByContent(t *testing.T) {
+	t.Parallel()
+
+	d := Dir(t.TempDir())
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+	const msg = "Subject: duplicate\r\n\r\nsame content\r\n"
+	var keys []string
+	for _, s := range []string{msg, msg, "Subject: other\r\n\r\ndifferent content\r\n"} {
+		key, err := d.Deliver(strings.NewReader(s), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, key)
+	}
+	if _, err := d.Unseen(); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.SetFlags(keys[1], []Flag{FlagFlagged}); err != nil {
+		t.Fatal(err)
+	}
+
+	saved, err := d.DeduplicateByContent()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved != int64(len(msg)) {
+		t.Errorf("Dir.DeduplicateByContent() = %v, want %v", saved, len(msg))
+	}
+
+	var infos []os.FileInfo
+	for _, key := range keys {
+		filename, err := d.Filename(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fi, err := os.Stat(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		infos = append(infos, fi)
+	}
+	if !os.SameFile(infos[0], infos[1]) {
+		t.Error("duplicate messages don't share the same file")
+	}
+	if os.SameFile(infos[0], infos[2]) {
+		t.Error("different messages share the same file")
+	}
+	if flags, err := d.Flags(keys[1]); err != nil {
+		t.Fatal(err)
+	} else if len(flags) != 1 || flags[0] != FlagFlagged {
+		t.Errorf("Dir.Flags() = %v, want [%v]", flags, FlagFlagged)
+	}
+	if filename, err := d.Filename(keys[0]); err != nil {
+		t.Fatal(err)
+	} else if got := cat(t, filename); got != msg {
+		t.Errorf("message content = %q, want %q", got, msg)
+	}
+
+	// running it again is a no-op
+	if saved, err := d.DeduplicateByContent(); err != nil {
+		t.Fatal(err)
+	} else if saved != 0 {
+		t.Errorf("Dir.DeduplicateByContent() = %v, want 0", saved)
+	}
+}
+
+func TestDedupWindow(t *testing.T) {
+	t.Parallel()
+
+	d := Dir(t.TempDir())
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1600000000, 0)
+	w := d.WithDedupWindow(time.Minute)
+	w.now = func() time.Time { return now }
+
+	const msg = "Message-ID: <1234@example.org>\r\nSubject: loop\r\n\r\nagain\r\n"
+	key, err := w.Deliver(strings.NewReader(msg), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now = now.Add(30 * time.Second)
+	if dup, err := w.Deliver(strings.NewReader(msg), nil); err != nil {
+		t.Fatal(err)
+	} else if dup != key {
+		t.Errorf("DedupWindow.Deliver() = %q within the window, want %q", dup, key)
+	}
+	if n, err := d.UnseenCount(); err != nil {
+		t.Fatal(err)
+	} else if n != 1 {
+		t.Errorf("Dir.UnseenCount() = %v, want 1", n)
+	}
+
+	// messages without a Message-ID are always delivered
+	for i := 0; i < 2; i++ {
+		if _, err := w.Deliver(strings.NewReader("Subject: no id\r\n\r\n"), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	now = now.Add(time.Minute)
+	if again, err := w.Deliver(strings.NewReader(msg), nil); err != nil {
+		t.Fatal(err)
+	} else if again == key {
+		t.Errorf("DedupWindow.Deliver() = %q after the window, want a new key", again)
+	}
+	if n, err := d.UnseenCount(); err != nil {
+		t.Fatal(err)
+	} else if n != 4 {
+		t.Errorf("Dir.UnseenCount() = %v, want 4", n)
+	}
+}
+
+func TestDedupWindow_concurrent(t *testing.T) {
+	t.Parallel()
+
+	d := Dir(t.TempDir())
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+	w := d.WithDedupWindow(time.Minute)
+
+	const msg = "Message-ID: <5678@example.org>\r\nSubject: race\r\n\r\nonce\r\n"
+	keys := make([]string, 8)
+	errs := make([]error, len(keys))
+	var wg sync.WaitGroup
+	for i := range keys {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			keys[i], errs[i] = w.Deliver(strings.NewReader(msg), nil)
+		}(i)
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		} else if keys[i] != keys[0] {
+			t.Errorf("DedupWindow.Deliver() = %q, want %q", keys[i], keys[0])
+		}
+	}
+	if n, err := d.UnseenCount(); err != nil {
+		t.Fatal(err)
+	} else if n != 1 {
+		t.Errorf("Dir.UnseenCount() = %v, want 1", n)
+	}
+}
@@ -0,0 +1,892 @@
+package maildir
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DeliveryOptions contains optional parameters for a Delivery. A nil
+// *DeliveryOptions is equivalent to the zero value.
+type DeliveryOptions struct {
+	// AfterPublish is called by Close once the message has been moved to new,
+	// with the key and the path of the delivered message. This allows callers
+	// to e.g. index a message before the delivery is reported as done.
+	//
+	// The message is not rolled back if AfterPublish returns an error: it is
+	// already visible to readers of the Maildir at that point. The error is
+	// returned by Close.
+	AfterPublish func(key, filename string) error
+
+	// AfterPublishContext works like AfterPublish, but is also given the
+	// context of the delivery, see Dir.DeliverContext. It is called after
+	// AfterPublish.
+	AfterPublishContext func(ctx context.Context, key, filename string) error
+
+	// MatchDirPermissions makes the delivered file inherit the permission
+	// bits of the cur directory (without the execute bits) and, on Unix, its
+	// group, so that Maildirs shared between several users work without
+	// manual intervention.
+	MatchDirPermissions bool
+
+	// Checksum records the SHA-256 checksum of the message, computed while it
+	// is written, in the Maildir root. See Dir.VerifyChecksums.
+	Checksum bool
+
+	// MaxSize is the maximum size of the message in bytes. If more data is
+	// written, the delivery is aborted and ErrMessageTooLarge is returned.
+	// Zero means no limit.
+	MaxSize int64
+
+	// EnforceQuota aborts the delivery with ErrQuotaExceeded if the message
+	// would exceed the Maildir++ quota, see Dir.Quota. Successful deliveries
+	// are then accounted in the maildirsize file. Nothing is done if the
+	// Maildir has no quota.
+	EnforceQuota bool
+
+	// Length, if positive, is the declared length of the message, e.g. from
+	// the framing of the protocol it has been received with. Data written
+	// past Length is silently discarded, so that trailing garbage appended
+	// by a broken source isn't stored.
+	//
+	// This is an advanced option: data is lost if the declared length is
+	// wrong.
+	Length int64
+
+	// DeliveredTo is the address of the recipient of the message. If set,
+	// a Delivered-To header field is prepended to the message, and the
+	// delivery fails with ErrLoopDetected if the message already has one for
+	// this address. It is only used by Dir.Deliver.
+	DeliveredTo string
+
+	// AddDate prepends a Date header field set to the delivery time to
+	// messages which don't have one, as many MDAs do. It is only used by
+	// Dir.Deliver.
+	AddDate bool
+
+	// Sync flushes new to stable storage once the message has been moved to
+	// it, so that the message survives a crash once Close returns. The
+	// message itself is always flushed before being moved.
+	Sync bool
+
+	// Transform, if set, wraps the message as it is read, e.g. to sign or
+	// rewrite it on the fly. It is applied after the other options changing
+	// the content of the message. If the returned reader fails, the delivery
+	// is aborted. It is only used by Dir.Deliver.
+	Transform func(io.Reader) io.Reader
+
+	// TmpFile writes the message to an unnamed temporary file, which is
+	// linked into new on Close, instead of a file in tmp. This way, no stale
+	// file is left in tmp if the delivery is interrupted. This is only
+	// supported on Linux, with filesystems supporting O_TMPFILE; a file in
+	// tmp is used otherwise.
+	TmpFile bool
+
+	// Subdir is the subdirectory of the Maildir the message is delivered to,
+	// e.g. a staging area for spam in custom layouts. It must exist. The
+	// message is still written to tmp first and atomically linked into Subdir
+	// on Close. Defaults to new.
+	Subdir string
+
+	// Sender is the envelope sender of the message. It is only reported to
+	// OnDeliver.
+	Sender string
+
+	// OnDeliver is called by Close after each successful delivery, e.g. to
+	// keep an audit trail of the deliveries.
+	OnDeliver func(DeliverRecord)
+
+	// ReadOnly makes the message file read-only (mode 0400) once it has been
+	// published, to protect messages of e.g. archival folders from accidental
+	// modifications. The flag operations and Remove of this package make the
+	// file writable temporarily when needed.
+	ReadOnly bool
+
+	// Discard, if set, is called by Close with the path of the complete
+	// message in tmp before it is published, e.g. to let a filter scan it. If
+	// it returns true, the message is silently discarded: it is removed from
+	// tmp and Close returns ErrDiscarded. TmpFile is ignored if Discard is set.
+	Discard func(tmppath string) bool
+
+	// KeyFormat is the format of the key of the message, e.g. to match the
+	// conventions of the IMAP server also reading the Maildir.
+	KeyFormat KeyFormat
+}
+
+// A DeliverRecord describes a successful delivery, see
+// DeliveryOptions.OnDeliver.
+type DeliverRecord struct {
+	Key       string
+	Size      int64
+	Sender    string // DeliveryOptions.Sender
+	Recipient string // DeliveryOptions.DeliveredTo
+	Time      time.Time
+
+	// Context is the context of the delivery, e.g. to extract a trace ID. It
+	// is context.Background() unless the message has been delivered with
+	// Dir.DeliverContext.
+	Context context.Context
+}
+
+// ErrDiscarded is returned when a message is discarded by
+// DeliveryOptions.Discard.
+var ErrDiscarded = errors.New("maildir: message discarded")
+
+// ErrReadOnly is returned when delivering to a Maildir which isn't writable,
+// e.g. because of its permissions or a read-only mount. It is wrapped in an
+// *os.PathError.
+var ErrReadOnly = errors.New("maildir: maildir is read-only")
+
+// ErrMaildirRemoved is returned when the subdirectory a message is
+// delivered to has been removed while the message was written to tmp, e.g.
+// because the Maildir was deleted by another process.
+var ErrMaildirRemoved = errors.New("maildir: maildir has been removed")
+
+// ErrMessageTooLarge is returned when a message exceeds
+// DeliveryOptions.MaxSize.
+var ErrMessageTooLarge = errors.New("maildir: message too large")
+
+// Delivery represents an ongoing message delivery to the mailbox. It
+// implements the io.WriteCloser interface. On Close the underlying file is
+// moved/relinked to new.
+//
+// Multiple processes can perform a delivery on the same Maildir concurrently.
+type Delivery struct {
+	file *os.File
+	d    Dir
+	key  string
+	opts DeliveryOptions
+	hash hash.Hash
+	size int64
+	err  error // set once the delivery has been aborted by Write
+	ctx  context.Context
+
+	// deferDirSync leaves the synchronization of new to the caller, see
+	// Session.
+	deferDirSync bool
+	// unnamed is set if file is an unnamed temporary file, see
+	// DeliveryOptions.TmpFile.
+	unnamed bool
+	// info, if set, is the info section of the message, which is then
+	// delivered to cur.
+	info string
+	// fixedKey is set if the key has been chosen by the caller, and mustn't
+	// be regenerated on collision, see Dir.DeliverUnique.
+	fixedKey bool
+}
+
+// NewDelivery creates a new Delivery.
+func NewDelivery(d string) (*Delivery, error) {
+	return NewDeliveryWithOptions(d, nil)
+}
+
+// NewDelivery creates a new Delivery to d. The message is written to a
+// uniquely named file in tmp, which is flushed and moved to new on Close, or
+// removed on Abort.
+func (d Dir) NewDelivery() (*Delivery, error) {
+	return NewDelivery(string(d))
+}
+
+// NewDeliveryWithOptions creates a new Delivery with the given options.
+func NewDeliveryWithOptions(d string, opts *DeliveryOptions) (*Delivery, error) {
+	del := &Delivery{ctx: context.Background()}
+	if opts != nil {
+		del.opts = *opts
+	}
+	var key string
+	var file *os.File
+	var err error
+	if del.opts.TmpFile && del.opts.Discard == nil {
+		key, err = newKeyFormat(del.opts.KeyFormat)
+		if err != nil {
+			return nil, err
+		}
+		file, err = openTmpFile(filepath.Join(d, "tmp"))
+		del.unnamed = err == nil
+	}
+	if !del.unnamed {
+		key, file, err = createTmp(d, del.opts.KeyFormat)
+		if isReadOnly(err) {
+			return nil, &os.PathError{Op: "deliver", Path: filepath.Join(d, "tmp"), Err: ErrReadOnly}
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	filename := file.Name()
+	if del.opts.MatchDirPermissions {
+		if err := matchDirPermissions(file, filepath.Join(d, "cur")); err != nil {
+			file.Close()
+			if !del.unnamed {
+				os.Remove(filename)
+			}
+			return nil, err
+		}
+	}
+	if del.opts.Checksum {
+		del.hash = sha256.New()
+	}
+	del.file = file
+	del.d = Dir(d)
+	del.key = key
+	return del, nil
+}
+
+// isReadOnly reports whether err is caused by a directory which can't be
+// written to.
+func isReadOnly(err error) bool {
+	return errors.Is(err, os.ErrPermission) || errors.Is(err, errReadOnlyFS)
+}
+
+// maxKeyRetries is the number of times a new key is generated when the key of
+// a delivery collides with an existing file.
+const maxKeyRetries = 10
+
+// retryKey calls fn with key, and then with new keys of the given format while
+// fn fails with an error satisfying os.IsExist, at most maxKeyRetries times.
+// It returns the last key fn has been called with, or an empty key if a new
+// key couldn't be generated.
+func retryKey(key string, format KeyFormat, fn func(key string) error) (string, error) {
+	for i := 0; ; i++ {
+		err := fn(key)
+		if !os.IsExist(err) || i >= maxKeyRetries {
+			return key, err
+		}
+		if key, err = newKeyFormat(format); err != nil {
+			return "", err
+		}
+	}
+}
+
+// createTmp creates a file in tmp for a new delivery. A new key is generated
+// if the file already exists in tmp or new.
+func createTmp(d string, format KeyFormat) (string, *os.File, error) {
+	for i := 0; ; i++ {
+		key, err := newKeyFormat(format)
+		if err != nil {
+			return "", nil, err
+		}
+		if _, err := os.Lstat(filepath.Join(d, "new", key)); err == nil && i < maxKeyRetries {
+			continue
+		}
+		filename := filepath.Join(d, "tmp", key)
+		file, err := os.OpenFile(filename, os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0666)
+		if os.IsExist(err) && i < maxKeyRetries {
+			continue
+		} else if err != nil {
+			return "", nil, err
+		}
+		return key, file, nil
+	}
+}
+
+// Deliver delivers the message read from r to new and returns its key.
+// The message is removed from tmp if an error occurs while reading r.
+//
+// The message is stored byte for byte, without any line ending normalization,
+// so that e.g. DKIM signatures remain valid. Only the options adding header
+// fields or transforming the message modify it.
+func (d Dir) Deliver(r io.Reader, opts *DeliveryOptions) (string, error) {
+	return d.DeliverContext(context.Background(), r, opts)
+}
+
+// DeliverContext works like Deliver, but aborts the delivery if ctx is
+// cancelled while the message is read, and passes ctx to the hooks of opts,
+// e.g. so that they can be correlated with a request trace.
+func (d Dir) DeliverContext(ctx context.Context, r io.Reader, opts *DeliveryOptions) (string, error) {
+	del, err := d.deliver(ctx, r, opts, false)
+	if err != nil {
+		return "", err
+	}
+	return del.key, nil
+}
+
+// ctxReader is an io.Reader failing once its context is done.
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r ctxReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
+
+// deliver implements Deliver, and returns the closed Delivery.
+func (d Dir) deliver(ctx context.Context, r io.Reader, opts *DeliveryOptions, deferDirSync bool) (*Delivery, error) {
+	if ctx.Done() != nil {
+		r = ctxReader{ctx, r}
+	}
+	if opts != nil && opts.AddDate {
+		var err error
+		r, err = prependDate(r, time.Now())
+		if err != nil {
+			return nil, err
+		}
+	}
+	if opts != nil && opts.DeliveredTo != "" {
+		var err error
+		r, err = prependDeliveredTo(r, opts.DeliveredTo)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if opts != nil && opts.Transform != nil {
+		r = opts.Transform(r)
+	}
+	del, err := NewDeliveryWithOptions(string(d), opts)
+	if err != nil {
+		return nil, err
+	}
+	del.deferDirSync = deferDirSync
+	del.ctx = ctx
+	if _, err := io.Copy(del, r); err != nil {
+		del.Abort()
+		return nil, err
+	}
+	if err := del.Close(); err != nil {
+		return nil, err
+	}
+	return del, nil
+}
+
+// ErrLengthMismatch is returned by Dir.DeliverChunks when the message is
+// shorter than its declared length.
+var ErrLengthMismatch = errors.New("maildir: message length doesn't match the declared length")
+
+// DeliverChunks delivers a message of totalLen bytes read from r, e.g. the
+// concatenation of the chunks received with the SMTP BDAT command, and returns
+// its key. Exactly totalLen bytes are read from r: the delivery is aborted
+// with ErrLengthMismatch if r ends early.
+//
+// Without flags the message is delivered to new, like with Dir.Deliver.
+// Otherwise it is delivered to cur with the given flags.
+func (d Dir) DeliverChunks(r io.Reader, totalLen int64, flags ...Flag) (string, error) {
+	del, err := NewDelivery(string(d))
+	if err != nil {
+		return "", err
+	}
+	if len(flags) > 0 {
+		del.info = formatInfo(flags)
+	}
+	n, err := io.Copy(del, io.LimitReader(r, totalLen))
+	if err == nil && n != totalLen {
+		err = ErrLengthMismatch
+	}
+	if err != nil {
+		del.Abort()
+		return "", err
+	}
+	if err := del.Close(); err != nil {
+		return "", err
+	}
+	return del.key, nil
+}
+
+// DeliverFramed delivers each of the messages read from r, e.g. a pipe
+// shared by several messages, and returns their keys. Each message is
+// preceded by its length in bytes, as a 4-byte big-endian integer. Messages
+// are delivered atomically one after the other, like with DeliverChunks, until
+// r ends.
+//
+// If an error occurs, the keys of the messages delivered so far are returned
+// along with the error.
+func (d Dir) DeliverFramed(r io.Reader, flags ...Flag) ([]string, error) {
+	return d.deliverFramed(r, 4, flags)
+}
+
+// DeliverFramed64 works like DeliverFramed, but with lengths encoded as
+// 8-byte big-endian integers.
+func (d Dir) DeliverFramed64(r io.Reader, flags ...Flag) ([]string, error) {
+	return d.deliverFramed(r, 8, flags)
+}
+
+func (d Dir) deliverFramed(r io.Reader, prefixLen int, flags []Flag) ([]string, error) {
+	var keys []string
+	prefix := make([]byte, prefixLen)
+	for {
+		if _, err := io.ReadFull(r, prefix); err == io.EOF {
+			return keys, nil
+		} else if err != nil {
+			return keys, err
+		}
+		var n uint64
+		if prefixLen == 4 {
+			n = uint64(binary.BigEndian.Uint32(prefix))
+		} else {
+			n = binary.BigEndian.Uint64(prefix)
+		}
+		if n > math.MaxInt64 {
+			return keys, fmt.Errorf("maildir: invalid message length %d", n)
+		}
+		key, err := d.DeliverChunks(r, int64(n), flags...)
+		if err != nil {
+			return keys, err
+		}
+		keys = append(keys, key)
+	}
+}
+
+// DeliverUnique delivers the message read from r with a key using unique as
+// its delivery identifier, instead of a generated one, and returns the key.
+// This allows e.g. golden-file tests or deterministic replication. The key is
+// made of the delivery time, the hostname and unique, like generated keys.
+//
+// unique must not be empty, and must not contain a dot, a slash or the
+// Separator. The delivery fails if the key is already used.
+//
+// Without flags the message is delivered to new, like with Dir.Deliver.
+// Otherwise it is delivered to cur with the given flags.
+func (d Dir) DeliverUnique(unique string, r io.Reader, flags ...Flag) (string, error) {
+	if unique == "" || strings.ContainsAny(unique, "./\\\x00"+string(Separator)) {
+		return "", fmt.Errorf("maildir: invalid unique delivery identifier %q", unique)
+	}
+	host, err := keyHostname()
+	if err != nil {
+		return "", err
+	}
+	key := strconv.FormatInt(time.Now().Unix(), 10) + "." + host + "." + unique
+	file, err := os.OpenFile(filepath.Join(string(d), "tmp", key), os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0666)
+	if err != nil {
+		return "", err
+	}
+
+	del := &Delivery{ctx: context.Background(), file: file, d: d, key: key, fixedKey: true}
+	if len(flags) > 0 {
+		del.info = formatInfo(flags)
+	}
+	if _, err := io.Copy(del, r); err != nil {
+		del.Abort()
+		return "", err
+	}
+	if err := del.Close(); err != nil {
+		return "", err
+	}
+	return key, nil
+}
+
+// A PreparedDelivery is a message staged in tmp by Dir.Prepare, waiting to be
+// published by Commit or discarded by Rollback.
+type PreparedDelivery struct {
+	del  *Delivery
+	done bool
+}
+
+// Prepare writes the message read from r to tmp without publishing it. This
+// allows delivering a message to several Maildirs all-or-nothing: the message
+// is prepared for all of them first, then committed to all of them if
+// everything succeeded, and rolled back otherwise.
+func (d Dir) Prepare(r io.Reader) (*PreparedDelivery, error) {
+	del, err := NewDelivery(string(d))
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.Copy(del, r); err != nil {
+		del.Abort()
+		return nil, err
+	}
+	return &PreparedDelivery{del: del}, nil
+}
+
+// Key returns the key of the message. It may change on Commit if another
+// message has been delivered with the same key in the meantime.
+func (p *PreparedDelivery) Key() string {
+	return p.del.key
+}
+
+// Commit moves the message to new.
+func (p *PreparedDelivery) Commit() error {
+	if p.done {
+		return errors.New("maildir: delivery already committed or rolled back")
+	}
+	p.done = true
+	return p.del.Close()
+}
+
+// Rollback discards the message. It is a no-op if the delivery has already
+// been committed or rolled back, so it can be deferred.
+func (p *PreparedDelivery) Rollback() error {
+	if p.done {
+		return nil
+	}
+	p.done = true
+	return p.del.Abort()
+}
+
+// DeliverTo delivers the message read from r to several Maildirs, e.g. one
+// for each local recipient of the message, and returns its key in each of
+// them. The message is written once, and hard-linked into each Maildir when
+// possible; it is copied otherwise, e.g. if the Maildirs are on different
+// filesystems.
+//
+// Without flags the message is delivered to new, like with Dir.Deliver.
+// Otherwise it is delivered to cur with the given flags.
+//
+// A Maildir listed several times, possibly with different spellings of its
+// path, gets a single copy of the message, whose key is returned for each
+// spelling. A new key is generated if the key of the message collides with an
+// existing file.
+//
+// If an error occurs, the keys of the deliveries which succeeded are returned
+// along with the error.
+func DeliverTo(dirs []Dir, r io.Reader, flags ...Flag) (map[Dir]string, error) {
+	keys := make(map[Dir]string, len(dirs))
+	if len(dirs) == 0 {
+		return keys, nil
+	}
+
+	_, file, err := createTmp(string(dirs[0]), KeyFormatDefault)
+	if err != nil {
+		return keys, err
+	}
+	src := file.Name()
+	defer os.Remove(src)
+	_, err = io.Copy(file, r)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return keys, err
+	}
+
+	byPath := make(map[string]string, len(dirs))
+	for _, d := range dirs {
+		path := filepath.Clean(string(d))
+		key, ok := byPath[path]
+		if !ok {
+			if key, err = d.linkMessage(src, flags); err != nil {
+				return keys, err
+			}
+			byPath[path] = key
+		}
+		keys[d] = key
+	}
+	return keys, nil
+}
+
+// linkMessage delivers the file src to d with a new key, hard-linking it if
+// possible and copying it otherwise.
+func (d Dir) linkMessage(src string, flags []Flag) (string, error) {
+	key, err := newKey()
+	if err != nil {
+		return "", err
+	}
+	// the copy of src in tmp, if it can't be linked
+	var tmppath string
+	defer func() {
+		if tmppath != "" {
+			os.Remove(tmppath)
+		}
+	}()
+	key, err = retryKey(key, KeyFormatDefault, func(key string) error {
+		dst := filepath.Join(string(d), "new", key)
+		if len(flags) > 0 {
+			dst = filepath.Join(string(d), "cur", key+string(Separator)+formatInfo(flags))
+		}
+		if tmppath == "" {
+			err := os.Link(src, dst)
+			if err == nil || os.IsExist(err) {
+				return err
+			}
+			path := filepath.Join(string(d), "tmp", key)
+			if err := copyFile(src, path); os.IsExist(err) {
+				return err
+			} else if err != nil {
+				os.Remove(path)
+				return err
+			}
+			tmppath = path
+		}
+		return os.Link(tmppath, dst)
+	})
+	if err != nil {
+		return "", err
+	}
+	return key, nil
+}
+
+// copyFile copies the file src to the new file dst.
+func copyFile(src, dst string) error {
+	r, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	w, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0666)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, r)
+	if err == nil {
+		err = w.Sync()
+	}
+	if closeErr := w.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// matchDirPermissions sets the mode and group of f to match the directory dir.
+func matchDirPermissions(f *os.File, dir string) error {
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	if err := f.Chmod(fi.Mode().Perm() &^ 0111); err != nil {
+		return err
+	}
+	return matchGroup(f, fi)
+}
+
+// Key returns the key of the message. It may change on Close if another
+// message has been delivered with the same key in the meantime.
+func (d *Delivery) Key() string {
+	return d.key
+}
+
+// Write implements io.Writer.
+func (d *Delivery) Write(p []byte) (int, error) {
+	if d.err != nil {
+		return 0, d.err
+	}
+	n := len(p)
+	if d.opts.Length > 0 && d.size+int64(len(p)) > d.opts.Length {
+		p = p[:d.opts.Length-d.size]
+	}
+	if d.opts.MaxSize > 0 && d.size+int64(len(p)) > d.opts.MaxSize {
+		d.Abort()
+		d.err = ErrMessageTooLarge
+		return 0, d.err
+	}
+	written, err := d.file.Write(p)
+	d.size += int64(written)
+	if d.hash != nil {
+		d.hash.Write(p[:written])
+	}
+	if err != nil {
+		return written, err
+	}
+	return n, nil
+}
+
+// Close closes the underlying file and moves it to new, or to
+// DeliveryOptions.Subdir if set. If that directory has been removed in the
+// meantime, the file is removed from tmp and ErrMaildirRemoved is returned.
+func (d *Delivery) Close() error {
+	if d.err != nil {
+		return d.err
+	}
+	tmppath := d.file.Name()
+	// the message must be on disk before it is made visible, otherwise a
+	// crash could leave a truncated message in new
+	if err := d.file.Sync(); err != nil {
+		d.file.Close()
+		if !d.unnamed {
+			os.Remove(tmppath)
+		}
+		return err
+	}
+	// unnamed files must be linked while they are still open
+	if !d.unnamed {
+		if err := d.file.Close(); err != nil {
+			return err
+		}
+	}
+	if d.opts.Discard != nil && d.opts.Discard(tmppath) {
+		d.err = ErrDiscarded
+		if err := os.Remove(tmppath); err != nil {
+			return err
+		}
+		return d.err
+	}
+	var quota *Quota
+	if d.opts.EnforceQuota {
+		var err error
+		quota, err = d.d.Quota()
+		if os.IsNotExist(err) {
+			err = nil
+		} else if err == nil && quota.exceeded(d.size) {
+			err = ErrQuotaExceeded
+		}
+		if err != nil {
+			if d.unnamed {
+				d.file.Close()
+			} else {
+				os.Remove(tmppath)
+			}
+			return err
+		}
+	}
+	newpath, err := d.link()
+	// link may have replaced the unnamed file with a named one
+	tmppath = d.file.Name()
+	if os.IsNotExist(err) {
+		if _, statErr := os.Stat(filepath.Join(string(d.d), d.subdir())); os.IsNotExist(statErr) {
+			err = ErrMaildirRemoved
+		}
+	}
+	if d.unnamed {
+		if closeErr := d.file.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if err != nil {
+		if !d.unnamed {
+			os.Remove(tmppath)
+		}
+		return err
+	}
+	if d.hash != nil {
+		if err := d.d.appendChecksum(d.key, d.hash.Sum(nil)); err != nil {
+			os.Remove(newpath)
+			if !d.unnamed {
+				os.Remove(tmppath)
+			}
+			return err
+		}
+	}
+	if !d.unnamed {
+		if err := os.Remove(tmppath); err != nil {
+			return err
+		}
+	}
+	if quota != nil {
+		if err := d.d.addQuotaUsage(d.size, 1); err != nil {
+			return err
+		}
+	}
+	if d.opts.ReadOnly {
+		if err := os.Chmod(newpath, readOnlyMode); err != nil {
+			return err
+		}
+	}
+	if d.opts.Sync && !d.deferDirSync {
+		if err := syncDir(filepath.Join(string(d.d), d.subdir())); err != nil {
+			return err
+		}
+	}
+	if d.opts.AfterPublish != nil {
+		if err := d.opts.AfterPublish(d.key, newpath); err != nil {
+			return err
+		}
+	}
+	if d.opts.AfterPublishContext != nil {
+		if err := d.opts.AfterPublishContext(d.ctx, d.key, newpath); err != nil {
+			return err
+		}
+	}
+	if d.opts.OnDeliver != nil {
+		d.opts.OnDeliver(DeliverRecord{
+			Key:       d.key,
+			Size:      d.size,
+			Sender:    d.opts.Sender,
+			Recipient: d.opts.DeliveredTo,
+			Time:      time.Now(),
+			Context:   d.ctx,
+		})
+	}
+	return nil
+}
+
+// subdir returns the subdirectory the message is delivered to.
+func (d *Delivery) subdir() string {
+	if d.opts.Subdir != "" {
+		return d.opts.Subdir
+	}
+	if d.info != "" {
+		return "cur"
+	}
+	return "new"
+}
+
+// link links the message file into its subdirectory and returns its path
+// there. A new key is generated if another message has been delivered with the
+// same key in the meantime.
+func (d *Delivery) link() (string, error) {
+	var newpath string
+	link := func(key string) error {
+		name := key
+		if d.info != "" {
+			name += string(Separator) + d.info
+		}
+		newpath = filepath.Join(string(d.d), d.subdir(), name)
+		if !d.unnamed {
+			return os.Link(d.file.Name(), newpath)
+		}
+		err := linkTmpFile(d.file, newpath)
+		if err != nil && !os.IsExist(err) {
+			// linkat needs /proc, which may not be mounted, e.g. in
+			// containers
+			if err := d.nameTmpFile(); err != nil {
+				return err
+			}
+			err = os.Link(d.file.Name(), newpath)
+		}
+		return err
+	}
+	if d.fixedKey {
+		return newpath, link(d.key)
+	}
+	var err error
+	d.key, err = retryKey(d.key, d.opts.KeyFormat, link)
+	if d.key == "" {
+		return "", err
+	}
+	return newpath, err
+}
+
+// nameTmpFile copies the unnamed temporary file to a named file in tmp, which
+// is used for the rest of the delivery.
+func (d *Delivery) nameTmpFile() error {
+	_, file, err := createTmp(string(d.d), d.opts.KeyFormat)
+	if err != nil {
+		return err
+	}
+	fi, err := d.file.Stat()
+	if err == nil && d.opts.MatchDirPermissions {
+		err = matchDirPermissions(file, filepath.Join(string(d.d), "cur"))
+	}
+	if err == nil {
+		_, err = io.Copy(file, io.NewSectionReader(d.file, 0, fi.Size()))
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return err
+	}
+	d.file.Close()
+	d.file, d.unnamed = file, false
+	return nil
+}
+
+// Abort closes the underlying file and removes it completely.
+func (d *Delivery) Abort() error {
+	if d.err != nil {
+		return nil
+	}
+	tmppath := d.file.Name()
+	err := d.file.Close()
+	if err != nil || d.unnamed {
+		return err
+	}
+	return os.Remove(tmppath)
+}
@@ -0,0 +1,910 @@
+package maildir
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+func TestDir_Deliver_AfterPublish(t *testing.T) {
+	t.Parallel()
+
+	d := Dir(t.TempDir())
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	const msg = "this is a message"
+	var gotKey, gotFilename string
+	opts := &DeliveryOptions{
+		AfterPublish: func(key, filename string) error {
+			gotKey, gotFilename = key, filename
+			if !exists(filename) {
+				t.Errorf("AfterPublish called before %v was published", filename)
+			} else if cat(t, filename) != msg {
+				t.Error("Content doesn't match")
+			}
+			return nil
+		},
+	}
+	key, err := d.Deliver(strings.NewReader(msg), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if gotKey != key {
+		t.Errorf("AfterPublish got key %q, want %q", gotKey, key)
+	}
+	if want := filepath.Join(string(d), "new", key); gotFilename != want {
+		t.Errorf("AfterPublish got filename %q, want %q", gotFilename, want)
+	}
+
+	// errors are reported, but the message stays delivered
+	errIndex := errors.New("index failed")
+	opts.AfterPublish = func(key, filename string) error {
+		return errIndex
+	}
+	if _, err := d.Deliver(strings.NewReader(msg), opts); err != errIndex {
+		t.Errorf("Dir.Deliver() = %v, want %v", err, errIndex)
+	}
+	if n, err := d.UnseenCount(); err != nil {
+		t.Fatal(err)
+	} else if n != 2 {
+		t.Errorf("Dir.UnseenCount() = %v, want 2", n)
+	}
+}
+
+func TestDir_Deliver_MaxSize(t *testing.T) {
+	t.Parallel()
+
+	d := Dir(t.TempDir())
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+	opts := &DeliveryOptions{MaxSize: 10}
+
+	// written in small chunks to make sure the limit is checked while
+	// streaming
+	under := iotest.OneByteReader(strings.NewReader("0123456789"))
+	if _, err := d.Deliver(under, opts); err != nil {
+		t.Errorf("Dir.Deliver() under the limit = %v", err)
+	}
+
+	over := iotest.OneByteReader(strings.NewReader("0123456789A"))
+	if _, err := d.Deliver(over, opts); err != ErrMessageTooLarge {
+		t.Errorf("Dir.Deliver() over the limit = %v, want %v", err, ErrMessageTooLarge)
+	}
+
+	if n, err := d.UnseenCount(); err != nil {
+		t.Fatal(err)
+	} else if n != 1 {
+		t.Errorf("Dir.UnseenCount() = %v, want 1", n)
+	}
+	if entries, err := d.ListTmp(); err != nil {
+		t.Fatal(err)
+	} else if len(entries) != 0 {
+		t.Errorf("Dir.ListTmp() = %v, want no leftover", entries)
+	}
+}
+
+func TestDelivery_KeyCollision(t *testing.T) {
+	// don't run this test in // as it sets a package variable
+	d := Dir(t.TempDir())
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{
+		filepath.Join(string(d), "tmp", "collide-tmp"),
+		filepath.Join(string(d), "new", "collide-new"),
+	} {
+		if err := ioutil.WriteFile(path, []byte("already there"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var queue []string
+	testHookNewKey = func() string {
+		if len(queue) == 0 {
+			return ""
+		}
+		key := queue[0]
+		queue = queue[1:]
+		return key
+	}
+	defer func() {
+		testHookNewKey = nil
+	}()
+
+	// collisions when the file is created in tmp
+	queue = []string{"collide-tmp", "collide-new", "collide-tmp"}
+	key, err := d.Deliver(strings.NewReader("first message"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.HasPrefix(key, "collide") {
+		t.Errorf("delivered with colliding key %q", key)
+	}
+
+	// collision when the file is moved to new
+	queue = []string{"late"}
+	del, err := NewDelivery(string(d))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := del.Write([]byte("second message")); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(string(d), "new", "late"), []byte("already there"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := del.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if del.key == "late" {
+		t.Error("delivered with colliding key")
+	}
+	if cat(t, filepath.Join(string(d), "new", del.key)) != "second message" {
+		t.Error("Content doesn't match")
+	}
+	if cat(t, filepath.Join(string(d), "new", "late")) != "already there" {
+		t.Error("existing message was overwritten")
+	}
+}
+
+func TestDir_Deliver_Length(t *testing.T) {
+	t.Parallel()
+
+	d := Dir(t.TempDir())
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	const msg = "Subject: framed\r\n\r\nthe body\r\n"
+	r := iotest.HalfReader(strings.NewReader(msg + "\x00\x00trailing junk"))
+	key, err := d.Deliver(r, &DeliveryOptions{
+		Length:   int64(len(msg)),
+		Checksum: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := cat(t, filepath.Join(string(d), "new", key)); got != msg {
+		t.Errorf("stored message = %q, want %q", got, msg)
+	}
+	if corrupted, err := d.VerifyChecksums(); err != nil {
+		t.Fatal(err)
+	} else if len(corrupted) != 0 {
+		t.Errorf("checksum of the truncated message doesn't match")
+	}
+}
+
+func TestDir_Deliver_DeliveredTo(t *testing.T) {
+	t.Parallel()
+
+	d := Dir(t.TempDir())
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+	opts := &DeliveryOptions{DeliveredTo: "bob@example.org"}
+
+	const msg = "Delivered-To: alice@example.org\nSubject: hi\n\nhello\n"
+	key, err := d.Deliver(strings.NewReader(msg), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored := cat(t, filepath.Join(string(d), "new", key))
+	if want := "Delivered-To: bob@example.org\n" + msg; stored != want {
+		t.Errorf("stored message = %q, want %q", stored, want)
+	}
+
+	// delivering the stored message again is a loop
+	if _, err := d.Deliver(strings.NewReader(stored), opts); err != ErrLoopDetected {
+		t.Errorf("Dir.Deliver() = %v, want %v", err, ErrLoopDetected)
+	}
+	if n, err := d.UnseenCount(); err != nil {
+		t.Fatal(err)
+	} else if n != 1 {
+		t.Errorf("Dir.UnseenCount() = %v, want 1", n)
+	}
+}
+
+func TestDeliverTo(t *testing.T) {
+	t.Parallel()
+
+	root := t.TempDir()
+	var dirs []Dir
+	for _, name := range []string{"alice", "bob", "carol"} {
+		d := Dir(filepath.Join(root, name))
+		if err := d.Init(); err != nil {
+			t.Fatal(err)
+		}
+		dirs = append(dirs, d)
+	}
+
+	const msg = "a message for everyone"
+	keys, err := DeliverTo(dirs, strings.NewReader(msg), FlagSeen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != len(dirs) {
+		t.Fatalf("DeliverTo() returned %v keys, want %v", len(keys), len(dirs))
+	}
+
+	var first os.FileInfo
+	for _, d := range dirs {
+		path, err := d.Filename(keys[d])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cat(t, path) != msg {
+			t.Errorf("Content in %v doesn't match", d)
+		}
+		if flags, err := d.Flags(keys[d]); err != nil {
+			t.Error(err)
+		} else if len(flags) != 1 || flags[0] != FlagSeen {
+			t.Errorf("Dir.Flags() = %v, want {FlagSeen}", flags)
+		}
+
+		fi, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if first == nil {
+			first = fi
+		} else if !os.SameFile(first, fi) {
+			t.Errorf("message in %v isn't a hard link", d)
+		}
+		if entries, err := d.ListTmp(); err != nil {
+			t.Fatal(err)
+		} else if len(entries) != 0 {
+			t.Errorf("Dir.ListTmp() = %v, want no leftover", entries)
+		}
+	}
+}
+
+func TestDeliverTo_collision(t *testing.T) {
+	// don't run this test in // as it sets a package variable
+	d := Dir(t.TempDir())
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(string(d), "new", "collide"), []byte("already there"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	// the first key is used for the file written once in tmp
+	queue := []string{"source", "collide"}
+	testHookNewKey = func() string {
+		if len(queue) == 0 {
+			return ""
+		}
+		key := queue[0]
+		queue = queue[1:]
+		return key
+	}
+	defer func() {
+		testHookNewKey = nil
+	}()
+
+	const msg = "a message for a single Maildir"
+	alias := Dir(string(d) + string(filepath.Separator))
+	keys, err := DeliverTo([]Dir{d, d, alias}, strings.NewReader(msg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 2 || keys[d] == "" || keys[alias] != keys[d] {
+		t.Fatalf("DeliverTo() = %v, want the same key for %q and %q", keys, d, alias)
+	}
+	if keys[d] == "collide" {
+		t.Error("delivered with colliding key")
+	}
+	if got := cat(t, filepath.Join(string(d), "new", "collide")); got != "already there" {
+		t.Errorf("colliding message = %q, want it untouched", got)
+	}
+	if got := cat(t, filepath.Join(string(d), "new", keys[d])); got != msg {
+		t.Errorf("delivered message = %q, want %q", got, msg)
+	}
+	if n, err := d.UnseenCount(); err != nil {
+		t.Fatal(err)
+	} else if n != 2 {
+		t.Errorf("Dir.UnseenCount() = %v, want 2", n)
+	}
+}
+
+func TestDir_Deliver_Transform(t *testing.T) {
+	t.Parallel()
+
+	d := Dir(t.TempDir())
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	opts := &DeliveryOptions{
+		Transform: func(r io.Reader) io.Reader {
+			b, err := ioutil.ReadAll(r)
+			if err != nil {
+				return iotest.ErrReader(err)
+			}
+			// only the header field is uppercased
+			return strings.NewReader(strings.Replace(string(b), "Subject: hello", "Subject: HELLO", 1))
+		},
+	}
+	const msg = "From: alice@example.org\r\nSubject: hello\r\n\r\nSubject: body\r\n"
+	key, err := d.Deliver(strings.NewReader(msg), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "From: alice@example.org\r\nSubject: HELLO\r\n\r\nSubject: body\r\n"
+	if got := cat(t, filepath.Join(string(d), "new", key)); got != want {
+		t.Errorf("stored message = %q, want %q", got, want)
+	}
+
+	// a failing transform aborts the delivery
+	errTransform := errors.New("transform failed")
+	opts.Transform = func(r io.Reader) io.Reader {
+		return iotest.ErrReader(errTransform)
+	}
+	if _, err := d.Deliver(strings.NewReader(msg), opts); err != errTransform {
+		t.Errorf("Dir.Deliver() = %v, want %v", err, errTransform)
+	}
+	if n, err := d.UnseenCount(); err != nil {
+		t.Fatal(err)
+	} else if n != 1 {
+		t.Errorf("Dir.UnseenCount() = %v, want 1", n)
+	}
+	if entries, err := d.ListTmp(); err != nil {
+		t.Fatal(err)
+	} else if len(entries) != 0 {
+		t.Errorf("Dir.ListTmp() = %v, want no leftover", entries)
+	}
+}
+
+func TestDir_Deliver_Subdir(t *testing.T) {
+	t.Parallel()
+
+	const msg = "Subject: spam\r\n\r\nbuy now\r\n"
+
+	d := Dir(t.TempDir())
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(string(d), "spam"), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	var published string
+	opts := &DeliveryOptions{
+		Subdir: "spam",
+		AfterPublish: func(key, filename string) error {
+			published = filename
+			return nil
+		},
+	}
+	key, err := d.Deliver(strings.NewReader(msg), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := filepath.Join(string(d), "spam", key)
+	if published != want {
+		t.Errorf("published filename = %q, want %q", published, want)
+	}
+	if got := cat(t, want); got != msg {
+		t.Errorf("stored message = %q, want %q", got, msg)
+	}
+	if n, err := d.UnseenCount(); err != nil {
+		t.Fatal(err)
+	} else if n != 0 {
+		t.Errorf("Dir.UnseenCount() = %v, want 0", n)
+	}
+	if entries, err := d.ListTmp(); err != nil {
+		t.Fatal(err)
+	} else if len(entries) != 0 {
+		t.Errorf("Dir.ListTmp() = %v, want no leftover", entries)
+	}
+
+	// a missing subdirectory fails the delivery without leaving anything in tmp
+	opts.Subdir = "missing"
+	if _, err := d.Deliver(strings.NewReader(msg), opts); err == nil {
+		t.Error("Dir.Deliver() to a missing subdirectory succeeded")
+	}
+	if entries, err := d.ListTmp(); err != nil {
+		t.Fatal(err)
+	} else if len(entries) != 0 {
+		t.Errorf("Dir.ListTmp() = %v, want no leftover", entries)
+	}
+}
+
+func TestDir_Deliver_OnDeliver(t *testing.T) {
+	t.Parallel()
+
+	d := Dir(t.TempDir())
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	var records []DeliverRecord
+	opts := &DeliveryOptions{
+		Sender:      "alice@example.org",
+		DeliveredTo: "bob@example.org",
+		OnDeliver: func(rec DeliverRecord) {
+			records = append(records, rec)
+		},
+	}
+	const msg = "Subject: hello\r\n\r\nhi\r\n"
+	before := time.Now()
+	key, err := d.Deliver(strings.NewReader(msg), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 {
+		t.Fatalf("OnDeliver called %v times, want 1", len(records))
+	}
+	rec := records[0]
+	if rec.Key != key {
+		t.Errorf("DeliverRecord.Key = %q, want %q", rec.Key, key)
+	}
+	// the size includes the prepended Delivered-To header field
+	if want := int64(len("Delivered-To: bob@example.org\r\n" + msg)); rec.Size != want {
+		t.Errorf("DeliverRecord.Size = %v, want %v", rec.Size, want)
+	}
+	if rec.Sender != "alice@example.org" {
+		t.Errorf("DeliverRecord.Sender = %q, want %q", rec.Sender, "alice@example.org")
+	}
+	if rec.Recipient != "bob@example.org" {
+		t.Errorf("DeliverRecord.Recipient = %q, want %q", rec.Recipient, "bob@example.org")
+	}
+	if rec.Time.Before(before) || rec.Time.After(time.Now()) {
+		t.Errorf("DeliverRecord.Time = %v, want the delivery time", rec.Time)
+	}
+
+	// failed deliveries aren't recorded
+	opts.MaxSize = 1
+	if _, err := d.Deliver(strings.NewReader(msg), opts); err == nil {
+		t.Fatal("Dir.Deliver() succeeded")
+	}
+	if len(records) != 1 {
+		t.Errorf("OnDeliver called %v times, want 1", len(records))
+	}
+}
+
+func TestDir_Deliver_AddDate(t *testing.T) {
+	t.Parallel()
+
+	d := Dir(t.TempDir())
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+	opts := &DeliveryOptions{AddDate: true}
+
+	const msg = "From: alice@example.org\nSubject: no date\n\nDate: not a header\n"
+	key, err := d.Deliver(strings.NewReader(msg), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := cat(t, filepath.Join(string(d), "new", key))
+	if !strings.HasSuffix(got, "\n"+msg) {
+		t.Fatalf("stored message = %q, want the original message after a Date field", got)
+	}
+	m, err := mail.ReadMessage(strings.NewReader(got))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dates := m.Header["Date"]; len(dates) != 1 {
+		t.Errorf("message has Date fields %q, want one", dates)
+	} else if date, err := m.Header.Date(); err != nil {
+		t.Errorf("invalid Date field: %v", err)
+	} else if time.Since(date) > time.Minute {
+		t.Errorf("Date = %v, want the delivery time", date)
+	}
+
+	// messages with a Date field are left untouched
+	const dated = "Date: Mon, 02 Jan 2006 15:04:05 -0700\r\nsubject: dated\r\n\r\nbody\r\n"
+	key, err = d.Deliver(strings.NewReader(dated), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := cat(t, filepath.Join(string(d), "new", key)); got != dated {
+		t.Errorf("stored message = %q, want %q", got, dated)
+	}
+}
+
+func TestDir_Prepare(t *testing.T) {
+	t.Parallel()
+
+	var dirs []Dir
+	for i := 0; i < 2; i++ {
+		d := Dir(t.TempDir())
+		if err := d.Init(); err != nil {
+			t.Fatal(err)
+		}
+		dirs = append(dirs, d)
+	}
+	const msg = "Subject: fan-out\r\n\r\nhello\r\n"
+
+	prepare := func() []*PreparedDelivery {
+		var prepared []*PreparedDelivery
+		for _, d := range dirs {
+			p, err := d.Prepare(strings.NewReader(msg))
+			if err != nil {
+				t.Fatal(err)
+			}
+			prepared = append(prepared, p)
+		}
+		return prepared
+	}
+
+	for _, p := range prepare() {
+		if err := p.Rollback(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, d := range dirs {
+		if n, err := d.UnseenCount(); err != nil {
+			t.Fatal(err)
+		} else if n != 0 {
+			t.Errorf("Dir.UnseenCount() = %v after Rollback, want 0", n)
+		}
+		if entries, err := d.ListTmp(); err != nil {
+			t.Fatal(err)
+		} else if len(entries) != 0 {
+			t.Errorf("Dir.ListTmp() = %v after Rollback, want no leftover", entries)
+		}
+	}
+
+	for i, p := range prepare() {
+		if err := p.Commit(); err != nil {
+			t.Fatal(err)
+		}
+		if err := p.Rollback(); err != nil {
+			t.Errorf("Rollback() after Commit() = %v", err)
+		}
+		if got := cat(t, filepath.Join(string(dirs[i]), "new", p.Key())); got != msg {
+			t.Errorf("stored message = %q, want %q", got, msg)
+		}
+	}
+}
+
+func TestDir_DeliverChunks(t *testing.T) {
+	t.Parallel()
+
+	d := Dir(t.TempDir())
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+	chunks := []string{"Subject: chunked\r\n", "\r\n", "first chunk, ", "last chunk\r\n"}
+	msg := strings.Join(chunks, "")
+	readers := func() io.Reader {
+		var rs []io.Reader
+		for _, c := range chunks {
+			rs = append(rs, strings.NewReader(c))
+		}
+		return io.MultiReader(rs...)
+	}
+
+	key, err := d.DeliverChunks(readers(), int64(len(msg)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := cat(t, filepath.Join(string(d), "new", key)); got != msg {
+		t.Errorf("stored message = %q, want %q", got, msg)
+	}
+
+	key, err = d.DeliverChunks(readers(), int64(len(msg)), FlagSeen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := cat(t, filepath.Join(string(d), "cur", key+string(Separator)+"2,S")); got != msg {
+		t.Errorf("stored message = %q, want %q", got, msg)
+	}
+
+	// data past the declared length is left unread
+	r := strings.NewReader(msg + "QUIT\r\n")
+	if _, err := d.DeliverChunks(r, int64(len(msg))); err != nil {
+		t.Fatal(err)
+	}
+	if r.Len() != len("QUIT\r\n") {
+		t.Errorf("%v bytes left unread, want %v", r.Len(), len("QUIT\r\n"))
+	}
+
+	if _, err := d.DeliverChunks(readers(), int64(len(msg)+1)); err != ErrLengthMismatch {
+		t.Errorf("Dir.DeliverChunks() = %v, want %v", err, ErrLengthMismatch)
+	}
+	if n, err := d.UnseenCount(); err != nil {
+		t.Fatal(err)
+	} else if n != 2 {
+		t.Errorf("Dir.UnseenCount() = %v, want 2", n)
+	}
+	if entries, err := d.ListTmp(); err != nil {
+		t.Fatal(err)
+	} else if len(entries) != 0 {
+		t.Errorf("Dir.ListTmp() = %v, want no leftover", entries)
+	}
+}
+
+func TestDir_NewDelivery_Concurrent(t *testing.T) {
+	t.Parallel()
+
+	d := Dir(t.TempDir())
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	const n = 50
+	keys := make(chan string, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			del, err := d.NewDelivery()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if _, err := fmt.Fprintf(del, "message number %d", i); err != nil {
+				del.Abort()
+				t.Error(err)
+				return
+			}
+			if err := del.Close(); err != nil {
+				t.Error(err)
+				return
+			}
+			keys <- del.Key()
+		}(i)
+	}
+	wg.Wait()
+	close(keys)
+
+	seen := make(map[string]bool)
+	for key := range keys {
+		if seen[key] {
+			t.Errorf("key %q delivered twice", key)
+		}
+		seen[key] = true
+	}
+	if count, err := d.UnseenCount(); err != nil {
+		t.Fatal(err)
+	} else if count != n || len(seen) != n {
+		t.Errorf("%v messages delivered with %v keys, want %v", count, len(seen), n)
+	}
+
+	// aborted deliveries leave nothing behind
+	del, err := d.NewDelivery()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.WriteString(del, "discarded"); err != nil {
+		t.Fatal(err)
+	}
+	if err := del.Abort(); err != nil {
+		t.Fatal(err)
+	}
+	if entries, err := d.ListTmp(); err != nil {
+		t.Fatal(err)
+	} else if len(entries) != 0 {
+		t.Errorf("Dir.ListTmp() = %v, want no leftover", entries)
+	}
+}
+
+func TestDir_Deliver_LineEndings(t *testing.T) {
+	t.Parallel()
+
+	d := Dir(t.TempDir())
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+	// mixed line endings, a bare CR and no final line ending, as a signed
+	// message may have
+	const msg = "DKIM-Signature: v=1; a=rsa-sha256;\r\n\tb=abc\nSubject: mixed\r\n\r\nline one\nline two\r\nbare\rcr\r\nno final newline"
+	for _, opts := range []*DeliveryOptions{nil, {Sync: true}, {Checksum: true}} {
+		key, err := d.Deliver(strings.NewReader(msg), opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := cat(t, filepath.Join(string(d), "new", key)); got != msg {
+			t.Errorf("stored message = %q, want %q", got, msg)
+		}
+	}
+}
+
+func TestDir_DeliverContext(t *testing.T) {
+	t.Parallel()
+
+	d := Dir(t.TempDir())
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	type traceKey struct{}
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), traceKey{}, "trace-42"))
+	defer cancel()
+
+	var published, recorded interface{}
+	opts := &DeliveryOptions{
+		AfterPublishContext: func(ctx context.Context, key, filename string) error {
+			published = ctx.Value(traceKey{})
+			return nil
+		},
+		OnDeliver: func(rec DeliverRecord) {
+			recorded = rec.Context.Value(traceKey{})
+		},
+	}
+	if _, err := d.DeliverContext(ctx, strings.NewReader("Subject: traced\r\n\r\n"), opts); err != nil {
+		t.Fatal(err)
+	}
+	if published != "trace-42" {
+		t.Errorf("context value in AfterPublishContext = %v, want %v", published, "trace-42")
+	}
+	if recorded != "trace-42" {
+		t.Errorf("context value in OnDeliver = %v, want %v", recorded, "trace-42")
+	}
+
+	// a cancelled context aborts the delivery
+	cancel()
+	if _, err := d.DeliverContext(ctx, strings.NewReader("Subject: cancelled\r\n\r\n"), nil); err != context.Canceled {
+		t.Errorf("Dir.DeliverContext() = %v, want %v", err, context.Canceled)
+	}
+	if n, err := d.UnseenCount(); err != nil {
+		t.Fatal(err)
+	} else if n != 1 {
+		t.Errorf("Dir.UnseenCount() = %v, want 1", n)
+	}
+	if entries, err := d.ListTmp(); err != nil {
+		t.Fatal(err)
+	} else if len(entries) != 0 {
+		t.Errorf("Dir.ListTmp() = %v, want no leftover", entries)
+	}
+}
+
+func TestDir_DeliverUnique(t *testing.T) {
+	t.Parallel()
+
+	d := Dir(t.TempDir())
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+	host, err := keyHostname()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const msg = "Subject: golden\r\n\r\n"
+	before := time.Now().Unix()
+	key, err := d.DeliverUnique("golden1", strings.NewReader(msg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	after := time.Now().Unix()
+	var want string
+	for sec := before; sec <= after; sec++ {
+		if want = fmt.Sprintf("%d.%s.golden1", sec, host); key == want {
+			break
+		}
+	}
+	if key != want {
+		t.Errorf("Dir.DeliverUnique() = %q, want %q", key, want)
+	}
+	if got := cat(t, filepath.Join(string(d), "new", key)); got != msg {
+		t.Errorf("stored message = %q, want %q", got, msg)
+	}
+
+	key, err = d.DeliverUnique("golden2", strings.NewReader(msg), FlagSeen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(key, "."+host+".golden2") {
+		t.Errorf("Dir.DeliverUnique() = %q, want a key ending with the unique identifier", key)
+	}
+	if got := cat(t, filepath.Join(string(d), "cur", key+string(Separator)+"2,S")); got != msg {
+		t.Errorf("stored message = %q, want %q", got, msg)
+	}
+
+	for _, unique := range []string{"", "a.b", "a/b", "a" + string(Separator) + "2,S"} {
+		if _, err := d.DeliverUnique(unique, strings.NewReader(msg)); err == nil {
+			t.Errorf("Dir.DeliverUnique(%q) succeeded", unique)
+		}
+	}
+}
+
+func TestDelivery_Close_maildirRemoved(t *testing.T) {
+	t.Parallel()
+
+	d := Dir(t.TempDir())
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+	del, err := d.NewDelivery()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.WriteString(del, "Subject: hello\r\n\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.RemoveAll(filepath.Join(string(d), "new")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := del.Close(); err != ErrMaildirRemoved {
+		t.Fatalf("Delivery.Close() = %v, want %v", err, ErrMaildirRemoved)
+	}
+	names, err := readdirnames(filepath.Join(string(d), "tmp"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 0 {
+		t.Errorf("tmp = %v, want no leftover file", names)
+	}
+}
+
+func TestDir_DeliverFramed(t *testing.T) {
+	t.Parallel()
+
+	msgs := []string{
+		"Subject: first\r\n\r\nHello\r\n",
+		"Subject: second\n\n\n\nbody\n\n\nwith\n\nmany\n\n\nnewlines\n\n",
+	}
+	tests := []struct {
+		name    string
+		size    int
+		deliver func(d Dir, r io.Reader, flags ...Flag) ([]string, error)
+	}{
+		{"32", 4, Dir.DeliverFramed},
+		{"64", 8, Dir.DeliverFramed64},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			d := Dir(t.TempDir())
+			if err := d.Init(); err != nil {
+				t.Fatal(err)
+			}
+			var buf bytes.Buffer
+			for _, msg := range msgs {
+				prefix := make([]byte, 8)
+				binary.BigEndian.PutUint64(prefix, uint64(len(msg)))
+				buf.Write(prefix[8-tc.size:])
+				buf.WriteString(msg)
+			}
+
+			keys, err := tc.deliver(d, &buf, FlagSeen)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(keys) != len(msgs) {
+				t.Fatalf("delivered %d messages, want %d", len(keys), len(msgs))
+			}
+			for i, key := range keys {
+				filename, err := d.Filename(key)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got := cat(t, filename); got != msgs[i] {
+					t.Errorf("message %d = %q, want %q", i, got, msgs[i])
+				}
+			}
+		})
+	}
+
+	d := Dir(t.TempDir())
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+	truncated := append([]byte{0, 0, 0, 10}, "short"...)
+	if _, err := d.DeliverFramed(bytes.NewReader(truncated)); err != ErrLengthMismatch {
+		t.Errorf("Dir.DeliverFramed() with a truncated message = %v, want %v", err, ErrLengthMismatch)
+	}
+}
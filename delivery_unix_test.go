@@ -0,0 +1,105 @@
+//go:build aix || darwin || dragonfly || freebsd || linux || netbsd || openbsd || solaris
+// +build aix darwin dragonfly freebsd linux netbsd openbsd solaris
+
+package maildir
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestDir_Init_Permissions(t *testing.T) {
+	t.Parallel()
+
+	d := Dir(filepath.Join(t.TempDir(), "Maildir"))
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"", "tmp", "new", "cur"} {
+		fi, err := os.Stat(filepath.Join(string(d), name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if mode := fi.Mode().Perm(); mode != 0700 {
+			t.Errorf("%q has mode %v, want %v", name, mode, os.FileMode(0700))
+		}
+	}
+}
+
+func TestDir_Deliver_MatchDirPermissions(t *testing.T) {
+	t.Parallel()
+
+	d := Dir(t.TempDir())
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+	cur := filepath.Join(string(d), "cur")
+	if err := os.Chmod(cur, 0750); err != nil {
+		t.Fatal(err)
+	}
+	// only privileged users can give the directory an arbitrary group,
+	// otherwise the test falls back to the current group
+	os.Chown(cur, -1, 4242)
+
+	key, err := d.Deliver(strings.NewReader("a shared message"), &DeliveryOptions{
+		MatchDirPermissions: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dirInfo, err := os.Stat(cur)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fileInfo, err := os.Stat(filepath.Join(string(d), "new", key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := fileInfo.Mode().Perm(); mode != 0640 {
+		t.Errorf("delivered file has mode %v, want %v", mode, os.FileMode(0640))
+	}
+	dirGid := dirInfo.Sys().(*syscall.Stat_t).Gid
+	fileGid := fileInfo.Sys().(*syscall.Stat_t).Gid
+	if fileGid != dirGid {
+		t.Errorf("delivered file has group %v, want %v", fileGid, dirGid)
+	}
+}
+
+func TestDir_Deliver_ReadOnlyMaildir(t *testing.T) {
+	t.Parallel()
+
+	for _, err := range []error{
+		&os.PathError{Op: "open", Path: "tmp/key", Err: syscall.EACCES},
+		&os.PathError{Op: "open", Path: "tmp/key", Err: syscall.EROFS},
+	} {
+		if !isReadOnly(err) {
+			t.Errorf("isReadOnly(%v) = false", err)
+		}
+	}
+	if isReadOnly(&os.PathError{Op: "open", Path: "tmp/key", Err: syscall.ENOENT}) {
+		t.Error("missing directories reported as read-only")
+	}
+
+	if os.Geteuid() == 0 {
+		t.Skip("permissions are ignored for root")
+	}
+	d := Dir(t.TempDir())
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+	tmp := filepath.Join(string(d), "tmp")
+	if err := os.Chmod(tmp, 0500); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chmod(tmp, 0700)
+
+	_, err := d.Deliver(strings.NewReader("Subject: read-only\r\n\r\n"), nil)
+	if !errors.Is(err, ErrReadOnly) {
+		t.Errorf("Dir.Deliver() = %v, want %v", err, ErrReadOnly)
+	}
+}
@@ -0,0 +1,19 @@
+//go:build !plan9
+// +build !plan9
+
+package maildir
+
+import (
+	"syscall"
+)
+
+// errNoSpace and errQuota are the errors reported when the filesystem is full
+// and when the disk quota of the user is exhausted, errReadOnlyFS when writing
+// to a read-only filesystem and errCrossDevice when renaming a file across
+// filesystems.
+var (
+	errNoSpace     error = syscall.ENOSPC
+	errQuota       error = syscall.EDQUOT
+	errReadOnlyFS  error = syscall.EROFS
+	errCrossDevice error = syscall.EXDEV
+)
@@ -0,0 +1,14 @@
+package maildir
+
+import (
+	"errors"
+)
+
+// Plan 9 reports errors as plain strings, without errno values to match
+// against: these are never returned by the system.
+var (
+	errNoSpace     = errors.New("no space left on device")
+	errQuota       = errors.New("disk quota exceeded")
+	errReadOnlyFS  = errors.New("read-only file system")
+	errCrossDevice = errors.New("cross-device link")
+)
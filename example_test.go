@@ -0,0 +1,92 @@
+package maildir_test
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/emersion/go-maildir"
+)
+
+func ExampleDir_NewDelivery() {
+	tmp, err := ioutil.TempDir("", "maildir")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	d := maildir.Dir(tmp)
+	if err := d.Init(); err != nil {
+		log.Fatal(err)
+	}
+
+	var msg bytes.Buffer
+	msg.WriteString("From: alice@example.org\r\n")
+	msg.WriteString("To: bob@example.org\r\n")
+	msg.WriteString("Subject: Hello\r\n")
+	msg.WriteString("\r\n")
+	msg.WriteString("Hi Bob!\r\n")
+
+	del, err := d.NewDelivery()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if _, err := io.Copy(del, &msg); err != nil {
+		del.Abort()
+		log.Fatal(err)
+	}
+	if err := del.Close(); err != nil {
+		log.Fatal(err)
+	}
+
+	keys, err := d.Unseen()
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println(len(keys), keys[0] == del.Key())
+	// Output: 1 true
+}
+
+func ExampleDir_AddFlags() {
+	tmp, err := ioutil.TempDir("", "maildir")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	d := maildir.Dir(tmp)
+	if err := d.Init(); err != nil {
+		log.Fatal(err)
+	}
+	key, err := d.Deliver(strings.NewReader("Subject: Hello\r\n\r\n"), nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if _, err := d.Unseen(); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := d.AddFlags(key, maildir.FlagSeen, maildir.FlagFlagged, maildir.FlagSeen); err != nil {
+		log.Fatal(err)
+	}
+	if err := d.RemoveFlags(key, maildir.FlagFlagged); err != nil {
+		log.Fatal(err)
+	}
+	if err := d.AddFlags(key, maildir.FlagReplied); err != nil {
+		log.Fatal(err)
+	}
+
+	flags, err := d.Flags(key)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, f := range flags {
+		fmt.Print(string(f))
+	}
+	fmt.Println()
+	// Output: RS
+}
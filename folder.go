@@ -0,0 +1,240 @@
+package maildir
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/emersion/go-maildir/maildirpp"
+)
+
+// DetectFolderSeparator infers the hierarchy separator used by the folders
+// stored under d from the names of the existing folders. It returns '.' for
+// Maildir++ folders (e.g. ".A.B") and '/' for folders stored as nested
+// directories (e.g. "A/B"). If there is no clue, the Maildir++ separator '.'
+// is returned.
+func (d Dir) DetectFolderSeparator() (rune, error) {
+	f, err := os.Open(string(d))
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	fis, err := f.Readdir(0)
+	if err != nil {
+		return 0, err
+	}
+
+	nested := false
+	for _, fi := range fis {
+		n := fi.Name()
+		if !fi.IsDir() || n == "tmp" || n == "new" || n == "cur" {
+			continue
+		}
+		if n[0] == '.' {
+			if strings.ContainsRune(n[1:], '.') {
+				return '.', nil
+			}
+			continue
+		}
+		if isMaildir(filepath.Join(string(d), n)) {
+			nested = true
+		}
+	}
+	if nested {
+		return '/', nil
+	}
+	return '.', nil
+}
+
+// folderMarker is the name of the file marking a Maildir as a Maildir++
+// folder.
+const folderMarker = "maildirfolder"
+
+// inbox is the IMAP name of the Maildir root.
+const inbox = "INBOX"
+
+// folder returns the Maildir++ folder with the given name under d. Levels of
+// the hierarchy are separated with '/' in name. By IMAP convention, INBOX
+// (case-insensitively) is d itself.
+//
+// Names with empty levels, e.g. "", "/" or "a//b", and names which don't
+// resolve to a directory right under d are rejected, so that the result can
+// safely be created or removed.
+func (d Dir) folder(name string) (Dir, error) {
+	root := filepath.Clean(string(d))
+	if strings.EqualFold(name, inbox) {
+		return Dir(root), nil
+	}
+	elems := strings.Split(name, "/")
+	for _, elem := range elems {
+		if elem == "" || strings.ContainsAny(elem, "\\\x00") {
+			return "", fmt.Errorf("maildir: invalid folder name %q", name)
+		}
+	}
+	key, err := maildirpp.Join(elems)
+	if err != nil {
+		return "", err
+	}
+	folder := filepath.Join(root, key)
+	if folder == root || filepath.Dir(folder) != root {
+		return "", fmt.Errorf("maildir: invalid folder name %q", name)
+	}
+	return Dir(folder), nil
+}
+
+// OpenFolder returns the existing Maildir++ folder with the given name under
+// d. Levels of the hierarchy are separated with '/' in name, e.g. "Work/2020"
+// is stored in ".Work.2020". INBOX (case-insensitively) is d itself, not a
+// ".INBOX" folder.
+func (d Dir) OpenFolder(name string) (Dir, error) {
+	folder, err := d.folder(name)
+	if err != nil {
+		return "", err
+	}
+	if _, err := os.Stat(string(folder)); err != nil {
+		return "", err
+	}
+	return folder, nil
+}
+
+// Folders returns the names of the Maildir++ folders under d, with the levels
+// of the hierarchy separated with '/', e.g. "Work/Projects" for the directory
+// ".Work.Projects". The names can be passed to Folder.
+func (d Dir) Folders() ([]string, error) {
+	f, err := os.Open(string(d))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fis, err := f.Readdir(0)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, fi := range fis {
+		n := fi.Name()
+		// skips cur, new and tmp as well
+		if !fi.IsDir() || len(n) < 2 || n[0] != '.' || n == ".." {
+			continue
+		}
+		elems, err := maildirpp.Split(n)
+		if err != nil {
+			continue
+		}
+		names = append(names, strings.Join(elems, "/"))
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// Folder returns the Maildir++ folder with the given name under d, which may
+// not exist. Levels of the hierarchy are separated with '/' in name, e.g.
+// "Work/Projects" is stored in ".Work.Projects". INBOX (case-insensitively) is
+// d itself. An error is returned if name isn't a valid folder name.
+func (d Dir) Folder(name string) (Dir, error) {
+	return d.folder(name)
+}
+
+// CreateFolder creates the Maildir++ folder with the given name under d, along
+// with its maildirfolder marker file, and returns it. Levels of the hierarchy
+// are separated with '/' in name. Creating an existing folder is not an error.
+func (d Dir) CreateFolder(name string) (Dir, error) {
+	folder, err := d.folder(name)
+	if err != nil {
+		return "", err
+	}
+	if err := folder.Init(); err != nil {
+		return "", err
+	}
+	f, err := os.OpenFile(filepath.Join(string(folder), folderMarker), os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return "", err
+	}
+	return folder, f.Close()
+}
+
+// RemoveFolder removes the Maildir++ folder with the given name under d and
+// all its messages. Its subfolders, e.g. "Work/2020" for "Work", are left
+// untouched. INBOX can't be removed, and invalid names are rejected before
+// anything is removed.
+func (d Dir) RemoveFolder(name string) error {
+	if strings.EqualFold(name, inbox) {
+		return errors.New("maildir: INBOX can't be removed")
+	}
+	folder, err := d.folder(name)
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(string(folder))
+}
+
+// CopyFolder creates the Maildir++ folder dstName under d, and copies all the
+// messages of the folder src into it. Messages are given new keys in the
+// destination folder, and keep their flags. Unseen messages stay unseen.
+func (d Dir) CopyFolder(src, dstName string) (Dir, error) {
+	from, err := d.folder(src)
+	if err != nil {
+		return "", err
+	}
+	to, err := d.CreateFolder(dstName)
+	if err != nil {
+		return "", err
+	}
+
+	_, err = to.Import(from)
+	return to, err
+}
+
+// Import copies all the messages of src into d, and returns the key of each
+// imported message in d by source key, e.g. to update an external index.
+// Messages are given new keys, and keep their flags. Unseen messages stay
+// unseen.
+//
+// If an error occurs, the keys of the messages imported so far are returned
+// along with the error.
+func (d Dir) Import(src Dir) (map[string]string, error) {
+	mapping := make(map[string]string)
+	keys, err := src.Keys()
+	if err != nil {
+		return mapping, err
+	}
+	for _, key := range keys {
+		newKey, err := src.Copy(d, key)
+		if err != nil {
+			return mapping, err
+		}
+		mapping[key] = newKey
+	}
+
+	names, err := readdirnames(filepath.Join(string(src), "new"))
+	if err != nil {
+		return mapping, err
+	}
+	for _, n := range names {
+		if n[0] == '.' {
+			continue
+		}
+		srcKey, err := parseKey(n)
+		if err != nil {
+			continue
+		}
+		key, err := newKey()
+		if err != nil {
+			return mapping, err
+		}
+		tmppath := filepath.Join(string(d), "tmp", key)
+		if err := copyFile(filepath.Join(string(src), "new", n), tmppath); err != nil {
+			os.Remove(tmppath)
+			return mapping, err
+		}
+		if err := os.Rename(tmppath, filepath.Join(string(d), "new", key)); err != nil {
+			return mapping, err
+		}
+		mapping[srcKey] = key
+	}
+	return mapping, nil
+}
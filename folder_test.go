@@ -0,0 +1,333 @@
+package maildir
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDir_DetectFolderSeparator(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		folders []string
+		want    rune
+	}{
+		{nil, '.'},
+		{[]string{".A", ".A.B"}, '.'},
+		{[]string{"A", "A/B"}, '/'},
+	} {
+		d := Dir(t.TempDir())
+		if err := d.Init(); err != nil {
+			t.Fatal(err)
+		}
+		for _, folder := range tc.folders {
+			if err := Dir(filepath.Join(string(d), folder)).Init(); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		sep, err := d.DetectFolderSeparator()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sep != tc.want {
+			t.Errorf("Dir.DetectFolderSeparator() with %v = %q, want %q", tc.folders, sep, tc.want)
+		}
+	}
+}
+
+func TestDir_CopyFolder(t *testing.T) {
+	t.Parallel()
+
+	root := Dir(t.TempDir())
+	if err := root.Init(); err != nil {
+		t.Fatal(err)
+	}
+	src, err := root.CreateFolder("Templates")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	flags := [][]Flag{{FlagSeen}, {FlagFlagged, FlagSeen}, {FlagDraft}}
+	contents := make(map[string][]Flag)
+	for i, f := range flags {
+		msg := fmt.Sprintf("template number %d", i)
+		makeDelivery(t, src, msg)
+		keys, err := src.Unseen()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := src.SetFlags(keys[0], f); err != nil {
+			t.Fatal(err)
+		}
+		contents[msg] = f
+	}
+	makeDelivery(t, src, "an unseen message")
+
+	dst, err := root.CopyFolder("Templates", "Copy/Of Templates")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := filepath.Join(string(root), ".Copy.Of Templates"); string(dst) != want {
+		t.Errorf("Dir.CopyFolder() = %v, want %v", dst, want)
+	}
+	if !exists(filepath.Join(string(dst), folderMarker)) {
+		t.Error("destination isn't marked as a Maildir++ folder")
+	}
+
+	keys, err := dst.Keys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != len(flags) {
+		t.Fatalf("destination has %v messages in cur, want %v", len(keys), len(flags))
+	}
+	for _, key := range keys {
+		path, err := dst.Filename(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want, ok := contents[cat(t, path)]
+		if !ok {
+			t.Errorf("unexpected message %v", key)
+			continue
+		}
+		got, err := dst.Flags(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if formatInfo(got) != formatInfo(want) {
+			t.Errorf("message %v has flags %v, want %v", key, got, want)
+		}
+	}
+	if n, err := dst.UnseenCount(); err != nil {
+		t.Fatal(err)
+	} else if n != 1 {
+		t.Errorf("Dir.UnseenCount() = %v, want 1", n)
+	}
+}
+
+func TestDir_OpenFolder(t *testing.T) {
+	t.Parallel()
+
+	d := Dir(t.TempDir())
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.CreateFolder("Work"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"INBOX", "inbox", "Inbox"} {
+		if folder, err := d.OpenFolder(name); err != nil {
+			t.Errorf("Dir.OpenFolder(%q) = %v", name, err)
+		} else if folder != d {
+			t.Errorf("Dir.OpenFolder(%q) = %q, want %q", name, folder, d)
+		}
+	}
+
+	folder, err := d.OpenFolder("Work")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := Dir(filepath.Join(string(d), ".Work")); folder != want {
+		t.Errorf("Dir.OpenFolder(%q) = %q, want %q", "Work", folder, want)
+	}
+
+	if _, err := d.OpenFolder("Missing"); !os.IsNotExist(err) {
+		t.Errorf("Dir.OpenFolder(%q) = %v, want a not exist error", "Missing", err)
+	}
+}
+
+func TestDir_Folders(t *testing.T) {
+	t.Parallel()
+
+	d := Dir(t.TempDir())
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"Sent", "Work", "Work/Projects"} {
+		if _, err := d.CreateFolder(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// files in the root aren't folders
+	if err := ioutil.WriteFile(filepath.Join(string(d), ".notafolder"), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	names, err := d.Folders()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"Sent", "Work", "Work/Projects"}
+	if strings.Join(names, ",") != strings.Join(want, ",") {
+		t.Errorf("Dir.Folders() = %q, want %q", names, want)
+	}
+
+	for _, name := range names {
+		folder, err := d.Folder(name)
+		if err != nil {
+			t.Errorf("Dir.Folder(%q) = %v", name, err)
+			continue
+		}
+		if want := filepath.Join(string(d), "."+strings.Replace(name, "/", ".", -1)); string(folder) != want {
+			t.Errorf("Dir.Folder(%q) = %q, want %q", name, folder, want)
+		}
+		if _, err := folder.Keys(); err != nil {
+			t.Errorf("Dir.Folder(%q).Keys() = %v", name, err)
+		}
+	}
+	if folder, err := d.Folder("INBOX"); err != nil || folder != d {
+		t.Errorf("Dir.Folder(%q) = %q, %v, want %q", "INBOX", folder, err, d)
+	}
+	if _, err := d.Folder("../Escape"); err == nil {
+		t.Errorf("Dir.Folder(%q) succeeded", "../Escape")
+	}
+}
+
+func TestDir_Import(t *testing.T) {
+	t.Parallel()
+
+	src := Dir(t.TempDir())
+	dst := Dir(t.TempDir())
+	for _, d := range []Dir{src, dst} {
+		if err := d.Init(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	contents := make(map[string]string)
+	for i := 0; i < 5; i++ {
+		msg := fmt.Sprintf("message number %d", i)
+		key, err := src.Deliver(strings.NewReader(msg), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		contents[key] = msg
+		if i < 3 {
+			if err := src.MarkSeen(key); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	mapping, err := dst.Import(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mapping) != len(contents) {
+		t.Errorf("Dir.Import() mapped %v keys, want %v", len(mapping), len(contents))
+	}
+	seen := make(map[string]bool)
+	for srcKey, msg := range contents {
+		dstKey, ok := mapping[srcKey]
+		if !ok {
+			t.Errorf("source key %v isn't mapped", srcKey)
+			continue
+		}
+		if seen[dstKey] {
+			t.Errorf("destination key %v mapped twice", dstKey)
+		}
+		seen[dstKey] = true
+
+		path, err := dst.Filename(dstKey)
+		if err != nil {
+			path = filepath.Join(string(dst), "new", dstKey)
+		}
+		if got := cat(t, path); got != msg {
+			t.Errorf("imported message %v = %q, want %q", dstKey, got, msg)
+		}
+	}
+	if n, err := dst.UnseenCount(); err != nil {
+		t.Fatal(err)
+	} else if n != 2 {
+		t.Errorf("Dir.UnseenCount() = %v, want 2", n)
+	}
+}
+
+func TestDir_CreateFolder(t *testing.T) {
+	t.Parallel()
+
+	d := Dir(t.TempDir())
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"Work", "Work/2020"} {
+		folder, err := d.CreateFolder(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want, err := d.Folder(name); err != nil || folder != want {
+			t.Errorf("Dir.CreateFolder(%q) = %q, want %q (%v)", name, folder, want, err)
+		}
+		if _, err := os.Stat(filepath.Join(string(folder), folderMarker)); err != nil {
+			t.Error(err)
+		}
+	}
+	names, err := d.Folders()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"Work", "Work/2020"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("Dir.Folders() = %v, want %v", names, want)
+	}
+
+	if err := d.RemoveFolder("INBOX"); err == nil {
+		t.Error("Dir.RemoveFolder(INBOX) succeeded")
+	}
+	if err := d.RemoveFolder("Work"); err != nil {
+		t.Fatal(err)
+	}
+	names, err = d.Folders()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"Work/2020"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("Dir.Folders() after RemoveFolder = %v, want %v", names, want)
+	}
+}
+
+func TestDir_RemoveFolder_invalidName(t *testing.T) {
+	t.Parallel()
+
+	parent := t.TempDir()
+	sentinel := filepath.Join(parent, "sentinel")
+	if err := ioutil.WriteFile(sentinel, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	d := Dir(filepath.Join(parent, "Maildir"))
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+	c := d.WithFolderCache()
+	for _, name := range []string{"", "/", "a//b", "..", "a/", "/a"} {
+		if err := d.RemoveFolder(name); err == nil {
+			t.Errorf("Dir.RemoveFolder(%q) succeeded", name)
+		}
+		if err := c.RemoveFolder(name); err == nil {
+			t.Errorf("FolderCache.RemoveFolder(%q) succeeded", name)
+		}
+		if folder, err := d.CreateFolder(name); err == nil {
+			t.Errorf("Dir.CreateFolder(%q) = %q, want an error", name, folder)
+		}
+	}
+
+	if _, err := os.Stat(sentinel); err != nil {
+		t.Errorf("file next to the Maildir: %v", err)
+	}
+	for _, path := range []string{string(d), filepath.Join(string(d), "cur")} {
+		if _, err := os.Stat(path); err != nil {
+			t.Error(err)
+		}
+	}
+	for _, path := range []string{string(d), parent} {
+		if _, err := os.Stat(filepath.Join(path, folderMarker)); !os.IsNotExist(err) {
+			t.Errorf("%v marked as a folder", path)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package maildir
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+)
+
+// Format is the format of a mail store, as reported by DetectFormat.
+type Format int
+
+const (
+	// The path isn't a known mail store.
+	FormatUnknown Format = iota
+	// The path is a Maildir without subfolders.
+	FormatMaildir
+	// The path is the root of a Maildir++ hierarchy: a Maildir with
+	// dot-prefixed subfolders.
+	FormatMaildirPlusPlus
+	// The path is an mbox file.
+	FormatMbox
+)
+
+// DetectFormat inspects path and reports which kind of mail store it holds.
+// An error is returned only if path can't be inspected at all.
+func DetectFormat(path string) (Format, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return FormatUnknown, err
+	}
+
+	if !fi.IsDir() {
+		if fi.Mode().IsRegular() && isMbox(path) {
+			return FormatMbox, nil
+		}
+		return FormatUnknown, nil
+	}
+
+	if !isMaildir(path) {
+		return FormatUnknown, nil
+	}
+
+	names, err := readdirnames(path)
+	if err != nil {
+		return FormatUnknown, err
+	}
+	for _, n := range names {
+		if len(n) > 1 && n[0] == '.' && isMaildir(filepath.Join(path, n)) {
+			return FormatMaildirPlusPlus, nil
+		}
+	}
+	return FormatMaildir, nil
+}
+
+// isMaildir checks whether path contains the tmp, new and cur directories.
+func isMaildir(path string) bool {
+	for _, sub := range []string{"tmp", "new", "cur"} {
+		fi, err := os.Stat(filepath.Join(path, sub))
+		if err != nil || !fi.IsDir() {
+			return false
+		}
+	}
+	return true
+}
+
+// isMbox checks whether the file at path starts with an mbox "From " line.
+func isMbox(path string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	b, err := bufio.NewReader(f).Peek(len("From "))
+	return err == nil && string(b) == "From "
+}
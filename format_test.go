@@ -0,0 +1,62 @@
+package maildir
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDetectFormat(t *testing.T) {
+	t.Parallel()
+
+	root := t.TempDir()
+
+	plain := Dir(filepath.Join(root, "plain"))
+	if err := plain.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	pp := Dir(filepath.Join(root, "pp"))
+	if err := pp.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if err := Dir(filepath.Join(string(pp), ".Sent")).Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	mbox := filepath.Join(root, "mbox")
+	const mboxContent = "From alice@example.org Thu Jan  1 00:00:00 1970\nSubject: hi\n\nhello\n"
+	if err := ioutil.WriteFile(mbox, []byte(mboxContent), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	text := filepath.Join(root, "text")
+	if err := ioutil.WriteFile(text, []byte("not a mailbox"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	empty := filepath.Join(root, "empty")
+	if err := os.Mkdir(empty, 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	for path, want := range map[string]Format{
+		string(plain): FormatMaildir,
+		string(pp):    FormatMaildirPlusPlus,
+		mbox:          FormatMbox,
+		text:          FormatUnknown,
+		empty:         FormatUnknown,
+	} {
+		got, err := DetectFormat(path)
+		if err != nil {
+			t.Errorf("DetectFormat(%q): %v", path, err)
+		} else if got != want {
+			t.Errorf("DetectFormat(%q) = %v, want %v", path, got, want)
+		}
+	}
+
+	if _, err := DetectFormat(filepath.Join(root, "missing")); !os.IsNotExist(err) {
+		t.Errorf("DetectFormat() on a missing path = %v, want a not exist error", err)
+	}
+}
@@ -0,0 +1,98 @@
+package maildir
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"net/mail"
+	"strings"
+	"time"
+)
+
+// readRawHeader reads the header block of a message from br, without any
+// processing. It returns the header and the blank line separating it from the
+// body, which is empty if the message has no body.
+func readRawHeader(br *bufio.Reader) (header, sep []byte, err error) {
+	for {
+		line, err := br.ReadBytes('\n')
+		if string(line) == "\n" || string(line) == "\r\n" {
+			return header, line, nil
+		}
+		header = append(header, line...)
+		if errors.Is(err, io.EOF) {
+			return header, nil, nil
+		} else if err != nil {
+			return nil, nil, err
+		}
+	}
+}
+
+// lineEnding returns the line ending used by a raw header, defaulting to CRLF.
+func lineEnding(header []byte) string {
+	if i := bytes.IndexByte(header, '\n'); i > 0 && header[i-1] != '\r' {
+		return "\n"
+	}
+	return "\r\n"
+}
+
+// ErrLoopDetected is returned when delivering a message which already has a
+// Delivered-To header field for DeliveryOptions.DeliveredTo.
+var ErrLoopDetected = errors.New("maildir: mail loop detected")
+
+// prependDeliveredTo returns a reader adding a Delivered-To header field for
+// addr to the message read from r, or ErrLoopDetected if the message already
+// has been delivered to addr.
+func prependDeliveredTo(r io.Reader, addr string) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	header, sep, err := readRawHeader(br)
+	if err != nil {
+		return nil, err
+	}
+
+	raw := append(append([]byte(nil), header...), sep...)
+	if len(sep) == 0 {
+		raw = append(raw, lineEnding(header)...)
+	}
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err == nil {
+		for _, v := range msg.Header["Delivered-To"] {
+			if strings.EqualFold(strings.TrimSpace(v), addr) {
+				return nil, ErrLoopDetected
+			}
+		}
+	}
+
+	field := "Delivered-To: " + addr + lineEnding(header)
+	return io.MultiReader(strings.NewReader(field), bytes.NewReader(header),
+		bytes.NewReader(sep), br), nil
+}
+
+// hasField reports whether a raw header has a field with the given name.
+func hasField(header []byte, name string) bool {
+	for _, line := range bytes.Split(header, []byte("\n")) {
+		i := bytes.IndexByte(line, ':')
+		if i > 0 && strings.EqualFold(string(bytes.TrimRight(line[:i], " \t")), name) {
+			return true
+		}
+	}
+	return false
+}
+
+// prependDate returns a reader adding a Date header field for t to the
+// message read from r if it doesn't have one. Only the header block is
+// buffered.
+func prependDate(r io.Reader, t time.Time) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	header, sep, err := readRawHeader(br)
+	if err != nil {
+		return nil, err
+	}
+
+	rest := io.MultiReader(bytes.NewReader(header), bytes.NewReader(sep), br)
+	if hasField(header, "Date") {
+		return rest, nil
+	}
+	field := "Date: " + t.Format(time.RFC1123Z) + lineEnding(header)
+	return io.MultiReader(strings.NewReader(field), rest), nil
+}
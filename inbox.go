@@ -0,0 +1,28 @@
+package maildir
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+)
+
+// Inbox returns the conventional Maildir of a user, "Maildir" in its home
+// directory.
+func Inbox(home string) Dir {
+	return Dir(filepath.Join(home, "Maildir"))
+}
+
+// MaildirFromEnv returns the Maildir of the current user according to the
+// environment: $MAILDIR if set, then $MAIL, and the Inbox of $HOME otherwise.
+func MaildirFromEnv() (Dir, error) {
+	for _, name := range []string{"MAILDIR", "MAIL"} {
+		if v := os.Getenv(name); v != "" {
+			return Dir(v), nil
+		}
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", errors.New("maildir: cannot find the Maildir: neither $MAILDIR, $MAIL nor $HOME is set")
+	}
+	return Inbox(home), nil
+}
@@ -0,0 +1,62 @@
+package maildir
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestInbox(t *testing.T) {
+	t.Parallel()
+
+	if got, want := Inbox("/home/user"), Dir(filepath.Join("/home/user", "Maildir")); got != want {
+		t.Errorf("Inbox() = %q, want %q", got, want)
+	}
+}
+
+func TestMaildirFromEnv(t *testing.T) {
+	if runtime.GOOS == "windows" || runtime.GOOS == "plan9" {
+		t.Skip("the home directory isn't taken from $HOME")
+	}
+	// don't run this test in // as it sets environment variables
+	for _, key := range []string{"MAILDIR", "MAIL", "HOME"} {
+		prev, ok := os.LookupEnv(key)
+		defer func(key string) {
+			if ok {
+				os.Setenv(key, prev)
+			} else {
+				os.Unsetenv(key)
+			}
+		}(key)
+	}
+
+	tests := []struct {
+		maildir, mail, home string
+		want                Dir
+	}{
+		{"/srv/mail/user", "/var/mail/user", "/home/user", "/srv/mail/user"},
+		{"", "/var/mail/user", "/home/user", "/var/mail/user"},
+		{"", "", "/home/user", Inbox("/home/user")},
+	}
+	for _, tc := range tests {
+		os.Setenv("MAILDIR", tc.maildir)
+		os.Setenv("MAIL", tc.mail)
+		os.Setenv("HOME", tc.home)
+		d, err := MaildirFromEnv()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if d != tc.want {
+			t.Errorf("MaildirFromEnv() with MAILDIR=%q MAIL=%q HOME=%q = %q, want %q",
+				tc.maildir, tc.mail, tc.home, d, tc.want)
+		}
+	}
+
+	os.Setenv("MAILDIR", "")
+	os.Setenv("MAIL", "")
+	os.Setenv("HOME", "")
+	if d, err := MaildirFromEnv(); err == nil {
+		t.Errorf("MaildirFromEnv() without environment = %q, want an error", d)
+	}
+}
@@ -0,0 +1,113 @@
+package maildir
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// A KeyFormat is a convention to generate the unique names of messages.
+type KeyFormat int
+
+const (
+	// KeyFormatDefault is the format used by this package, with the delivery
+	// time, the hostname, and a unique identifier made of the process ID, a
+	// counter and random bytes.
+	KeyFormatDefault KeyFormat = iota
+	// KeyFormatCourier is the format used by Courier:
+	// "<sec>.M<usec>P<pid>_<counter>.<host>".
+	KeyFormatCourier
+	// KeyFormatDovecot is the format used by Dovecot:
+	// "<sec>.M<usec>P<pid>Q<counter>.<host>".
+	KeyFormatDovecot
+)
+
+// newKeyFormat generates a new unique key in the given format.
+func newKeyFormat(format KeyFormat) (string, error) {
+	if format == KeyFormatDefault {
+		return newKey()
+	}
+	if testHookNewKey != nil {
+		if key := testHookNewKey(); key != "" {
+			return key, nil
+		}
+	}
+	host, err := keyHostname()
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	var sep string
+	switch format {
+	case KeyFormatCourier:
+		sep = "_"
+	case KeyFormatDovecot:
+		sep = "Q"
+	default:
+		return "", fmt.Errorf("maildir: unknown key format %d", format)
+	}
+	return fmt.Sprintf("%d.M%dP%d%s%d.%s", now.Unix(), now.Nanosecond()/1000,
+		os.Getpid(), sep, atomic.AddInt64(&id, 1), host), nil
+}
+
+// KeyInfo contains the information encoded in a key.
+type KeyInfo struct {
+	Format  KeyFormat
+	Time    time.Time // the delivery time, with microsecond precision
+	PID     int       // the ID of the delivering process
+	Counter int64     // the delivery counter of the delivering process
+	Host    string    // the hostname of the delivering machine
+}
+
+// ParseKeyInfo parses a key in the Courier or Dovecot format. Fields appended
+// to the hostname, such as ",S=<size>", are ignored.
+func ParseKeyInfo(key string) (*KeyInfo, error) {
+	parts := strings.SplitN(key, ".", 3)
+	if len(parts) != 3 || parts[2] == "" {
+		return nil, fmt.Errorf("maildir: invalid key %q", key)
+	}
+	sec, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("maildir: invalid time in key %q", key)
+	}
+	info := &KeyInfo{Host: parts[2]}
+	if i := strings.IndexByte(info.Host, ','); i >= 0 {
+		info.Host = info.Host[:i]
+	}
+
+	unique := parts[1]
+	var sep byte
+	switch {
+	case strings.Contains(unique, "_"):
+		info.Format, sep = KeyFormatCourier, '_'
+	case strings.Contains(unique, "Q"):
+		info.Format, sep = KeyFormatDovecot, 'Q'
+	default:
+		return nil, fmt.Errorf("maildir: unknown format for key %q", key)
+	}
+	var usec int64
+	var pid int
+	if !strings.HasPrefix(unique, "M") {
+		return nil, fmt.Errorf("maildir: invalid key %q", key)
+	}
+	p := strings.IndexByte(unique, 'P')
+	s := strings.IndexByte(unique, sep)
+	if p < 0 || s < p {
+		return nil, fmt.Errorf("maildir: invalid key %q", key)
+	}
+	if usec, err = strconv.ParseInt(unique[1:p], 10, 64); err != nil {
+		return nil, fmt.Errorf("maildir: invalid key %q", key)
+	}
+	if pid, err = strconv.Atoi(unique[p+1 : s]); err != nil {
+		return nil, fmt.Errorf("maildir: invalid key %q", key)
+	}
+	if info.Counter, err = strconv.ParseInt(unique[s+1:], 10, 64); err != nil {
+		return nil, fmt.Errorf("maildir: invalid key %q", key)
+	}
+	info.Time = time.Unix(sec, usec*1000)
+	info.PID = pid
+	return info, nil
+}
@@ -0,0 +1,92 @@
+package maildir
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseKeyInfo(t *testing.T) {
+	t.Parallel()
+
+	host, err := keyHostname()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, format := range []KeyFormat{KeyFormatCourier, KeyFormatDovecot} {
+		before := time.Now().Truncate(time.Microsecond)
+		key, err := newKeyFormat(format)
+		if err != nil {
+			t.Fatal(err)
+		}
+		info, err := ParseKeyInfo(key)
+		if err != nil {
+			t.Fatalf("ParseKeyInfo(%q) = %v", key, err)
+		}
+		if info.Format != format {
+			t.Errorf("ParseKeyInfo(%q).Format = %v, want %v", key, info.Format, format)
+		}
+		if info.Time.Before(before) || info.Time.After(time.Now()) {
+			t.Errorf("ParseKeyInfo(%q).Time = %v, want the generation time", key, info.Time)
+		}
+		if info.PID != os.Getpid() {
+			t.Errorf("ParseKeyInfo(%q).PID = %v, want %v", key, info.PID, os.Getpid())
+		}
+		if info.Host != host {
+			t.Errorf("ParseKeyInfo(%q).Host = %q, want %q", key, info.Host, host)
+		}
+	}
+
+	for _, tc := range []struct {
+		key     string
+		format  KeyFormat
+		counter int64
+		host    string
+	}{
+		{"1600000000.M123456P789_4.mail.example.org", KeyFormatCourier, 4, "mail.example.org"},
+		{"1600000000.M123456P789Q4.host,S=1024,W=1050", KeyFormatDovecot, 4, "host"},
+	} {
+		info, err := ParseKeyInfo(tc.key)
+		if err != nil {
+			t.Errorf("ParseKeyInfo(%q) = %v", tc.key, err)
+			continue
+		}
+		want := KeyInfo{tc.format, time.Unix(1600000000, 123456000), 789, tc.counter, tc.host}
+		if !info.Time.Equal(want.Time) {
+			t.Errorf("ParseKeyInfo(%q).Time = %v, want %v", tc.key, info.Time, want.Time)
+		}
+		info.Time = want.Time
+		if *info != want {
+			t.Errorf("ParseKeyInfo(%q) = %+v, want %+v", tc.key, *info, want)
+		}
+	}
+
+	for _, key := range []string{"", "1600000000", "1600000000.M1P2.host", "x.M1P2_3.host", "1600000000.P2_3.host"} {
+		if _, err := ParseKeyInfo(key); err == nil {
+			t.Errorf("ParseKeyInfo(%q) succeeded", key)
+		}
+	}
+}
+
+func TestDir_Deliver_KeyFormat(t *testing.T) {
+	t.Parallel()
+
+	d := Dir(t.TempDir())
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+	key, err := d.Deliver(strings.NewReader("Subject: dovecot\r\n\r\n"), &DeliveryOptions{KeyFormat: KeyFormatDovecot})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info, err := ParseKeyInfo(key); err != nil {
+		t.Fatal(err)
+	} else if info.Format != KeyFormatDovecot {
+		t.Errorf("key %q has format %v, want %v", key, info.Format, KeyFormatDovecot)
+	}
+	if _, err := os.Stat(filepath.Join(string(d), "new", key)); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,191 @@
+package maildir
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// keywordsFile is the name of the file, in the Maildir root, where Dovecot
+// maps the lowercase keyword letters of the info section to IMAP keywords.
+//
+// Each line is "<index> <keyword>", where index 0 stands for 'a', 1 for 'b'
+// and so on up to 25 for 'z'.
+const keywordsFile = "dovecot-keywords"
+
+// ErrTooManyKeywords is returned when a new keyword can't be assigned a letter
+// because all the 26 keyword letters are already in use.
+var ErrTooManyKeywords = errors.New("maildir: too many keywords")
+
+// readKeywords returns the keywords of keywordsFile, indexed by letter. The
+// result is empty if the file doesn't exist.
+func (d Dir) readKeywords() ([26]string, error) {
+	var keywords [26]string
+	b, err := ioutil.ReadFile(filepath.Join(string(d), keywordsFile))
+	if os.IsNotExist(err) {
+		return keywords, nil
+	} else if err != nil {
+		return keywords, err
+	}
+
+	s := bufio.NewScanner(bytes.NewReader(b))
+	for s.Scan() {
+		fields := strings.SplitN(s.Text(), " ", 2)
+		if len(fields) != 2 {
+			continue
+		}
+		i, err := strconv.Atoi(fields[0])
+		if err != nil || i < 0 || i >= len(keywords) {
+			return keywords, fmt.Errorf("maildir: invalid %v line: %q", keywordsFile, s.Text())
+		}
+		keywords[i] = fields[1]
+	}
+	return keywords, s.Err()
+}
+
+func (d Dir) writeKeywords(keywords [26]string) error {
+	var buf bytes.Buffer
+	for i, kw := range keywords {
+		if kw != "" {
+			fmt.Fprintf(&buf, "%d %s\n", i, kw)
+		}
+	}
+	return writeFileAtomic(d, keywordsFile, buf.Bytes())
+}
+
+// keywordFlag returns the letter mapped to keyword. If keyword has no letter
+// yet, the first free one is assigned to it when create is true, and ok is
+// false otherwise.
+func (d Dir) keywordFlag(keyword string, create bool) (f Flag, ok bool, err error) {
+	if keyword == "" || strings.ContainsAny(keyword, " \r\n") {
+		return 0, false, fmt.Errorf("maildir: invalid keyword %q", keyword)
+	}
+	keywords, err := d.readKeywords()
+	if err != nil {
+		return 0, false, err
+	}
+	free := -1
+	for i, kw := range keywords {
+		if kw == keyword {
+			return Flag('a' + i), true, nil
+		} else if kw == "" && free < 0 {
+			free = i
+		}
+	}
+	if !create {
+		return 0, false, nil
+	}
+	if free < 0 {
+		return 0, false, ErrTooManyKeywords
+	}
+	keywords[free] = keyword
+	if err := d.writeKeywords(keywords); err != nil {
+		return 0, false, err
+	}
+	return Flag('a' + free), true, nil
+}
+
+// isKeywordFlag reports whether f is a keyword letter, mapped to an IMAP
+// keyword by dovecot-keywords.
+func isKeywordFlag(f Flag) bool {
+	return f >= 'a' && f <= 'z'
+}
+
+// Keywords returns the IMAP keywords of a message, e.g. "$Junk", as stored by
+// Dovecot: lowercase letters of the info section mapped to keywords by the
+// dovecot-keywords file of the Maildir root. Letters without a mapping are
+// ignored.
+func (d Dir) Keywords(key string) ([]string, error) {
+	flags, err := d.Flags(key)
+	if err != nil {
+		return nil, err
+	}
+	keywords, err := d.readKeywords()
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, f := range flags {
+		if isKeywordFlag(f) && keywords[f-'a'] != "" {
+			names = append(names, keywords[f-'a'])
+		}
+	}
+	return names, nil
+}
+
+// SetKeywords replaces the IMAP keywords of a message, keeping its standard
+// flags. Keywords which aren't in dovecot-keywords yet are assigned the first
+// free letters; ErrTooManyKeywords is returned if there are none left.
+func (d Dir) SetKeywords(key string, keywords []string) error {
+	flags, err := d.Flags(key)
+	if err != nil {
+		return err
+	}
+	var changed []Flag
+	for _, f := range flags {
+		if !isKeywordFlag(f) {
+			changed = append(changed, f)
+		}
+	}
+	for _, kw := range keywords {
+		f, _, err := d.keywordFlag(kw, true)
+		if err != nil {
+			return err
+		}
+		changed = append(changed, f)
+	}
+	return d.SetFlags(key, changed)
+}
+
+// DeliverWithRetentionLabel delivers the message read from r to cur, tagged
+// with the retention label stored as a Dovecot keyword, and returns its key.
+// The label is added to dovecot-keywords if it isn't there yet.
+func (d Dir) DeliverWithRetentionLabel(r io.Reader, label string) (string, error) {
+	f, _, err := d.keywordFlag(label, true)
+	if err != nil {
+		return "", err
+	}
+	del, err := NewDelivery(string(d))
+	if err != nil {
+		return "", err
+	}
+	del.info = formatInfo([]Flag{f})
+	if _, err := io.Copy(del, r); err != nil {
+		del.Abort()
+		return "", err
+	}
+	if err := del.Close(); err != nil {
+		return "", err
+	}
+	return del.key, nil
+}
+
+// KeysWithRetention returns the keys of the messages in cur tagged with the
+// retention label, e.g. by DeliverWithRetentionLabel.
+func (d Dir) KeysWithRetention(label string) ([]string, error) {
+	f, ok, err := d.keywordFlag(label, false)
+	if err != nil || !ok {
+		return nil, err
+	}
+	entries, err := d.List()
+	if err != nil {
+		return nil, err
+	}
+	var keys []string
+	for _, e := range entries {
+		for _, flag := range e.Flags {
+			if flag == f {
+				keys = append(keys, e.Key)
+				break
+			}
+		}
+	}
+	return keys, nil
+}
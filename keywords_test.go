@@ -0,0 +1,114 @@
+package maildir
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDir_DeliverWithRetentionLabel(t *testing.T) {
+	t.Parallel()
+
+	d := Dir(t.TempDir())
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.DeliverWithRetentionLabel(strings.NewReader("Subject: other\r\n\r\n"), "retain-1y"); err != nil {
+		t.Fatal(err)
+	}
+	key, err := d.DeliverWithRetentionLabel(strings.NewReader("Subject: hello\r\n\r\n"), "retain-7y")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Deliver(strings.NewReader("Subject: untagged\r\n\r\n"), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	keys, err := d.KeysWithRetention("retain-7y")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || keys[0] != key {
+		t.Errorf("Dir.KeysWithRetention() = %v, want [%v]", keys, key)
+	}
+	flags, err := d.Flags(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(flags) != 1 || flags[0] != 'b' {
+		t.Errorf("Dir.Flags() = %v, want [b]", flags)
+	}
+	if got, want := cat(t, filepath.Join(string(d), keywordsFile)), "0 retain-1y\n1 retain-7y\n"; got != want {
+		t.Errorf("%v = %q, want %q", keywordsFile, got, want)
+	}
+
+	keys, err = d.KeysWithRetention("retain-30d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 0 {
+		t.Errorf("Dir.KeysWithRetention() = %v, want none", keys)
+	}
+}
+
+func TestDir_SetKeywords(t *testing.T) {
+	t.Parallel()
+
+	d := Dir(t.TempDir())
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+	// an existing mapping, as written by Dovecot
+	if err := ioutil.WriteFile(filepath.Join(string(d), keywordsFile), []byte("0 $Junk\n1 $Forwarded\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	key, err := d.Deliver(strings.NewReader("Subject: hello\r\n\r\n"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Unseen(); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.SetFlags(key, []Flag{FlagSeen, 'b'}); err != nil {
+		t.Fatal(err)
+	}
+	keywords, err := d.Keywords(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"$Forwarded"}; !reflect.DeepEqual(keywords, want) {
+		t.Errorf("Dir.Keywords() = %v, want %v", keywords, want)
+	}
+
+	if err := d.SetKeywords(key, []string{"work", "$Junk"}); err != nil {
+		t.Fatal(err)
+	}
+	flags, err := d.Flags(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(flagsRunes(flags)); got != "Sac" {
+		t.Errorf("Dir.Flags() = %q, want \"Sac\"", got)
+	}
+	keywords, err = d.Keywords(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"$Junk", "work"}; !reflect.DeepEqual(keywords, want) {
+		t.Errorf("Dir.Keywords() = %v, want %v", keywords, want)
+	}
+	if got, want := cat(t, filepath.Join(string(d), keywordsFile)), "0 $Junk\n1 $Forwarded\n2 work\n"; got != want {
+		t.Errorf("%v = %q, want %q", keywordsFile, got, want)
+	}
+
+	if err := d.SetKeywords(key, nil); err != nil {
+		t.Fatal(err)
+	}
+	if keywords, err := d.Keywords(key); err != nil {
+		t.Fatal(err)
+	} else if len(keywords) != 0 {
+		t.Errorf("Dir.Keywords() after clearing = %v, want none", keywords)
+	}
+}
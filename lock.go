@@ -0,0 +1,23 @@
+package maildir
+
+import (
+	"path/filepath"
+)
+
+// lockFile is the name of the file used by Dir.FLock in the Maildir root.
+const lockFile = "maildir-lock"
+
+// FLock acquires an exclusive advisory lock on the Maildir, blocking until it
+// is available, and returns a function releasing it.
+//
+// On most Unix systems, the lock is taken with flock(2) on a lock file in the
+// Maildir root. The kernel releases it when the file is closed, including
+// when the process dies, so stale locks can't happen. Elsewhere a dotlock is
+// used instead: the lock file is created exclusively and removed on unlock,
+// and is left behind if the process dies without unlocking.
+//
+// The lock is only advisory: it doesn't prevent other processes from
+// modifying the Maildir.
+func (d Dir) FLock() (unlock func(), err error) {
+	return lock(filepath.Join(string(d), lockFile))
+}
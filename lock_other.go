@@ -0,0 +1,26 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package maildir
+
+import (
+	"os"
+	"time"
+)
+
+// dotlockInterval is the delay between two attempts to take a dotlock.
+const dotlockInterval = 50 * time.Millisecond
+
+// lock takes a dotlock by creating the file at path exclusively.
+func lock(path string) (func(), error) {
+	for {
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0666)
+		if err == nil {
+			f.Close()
+			return func() { os.Remove(path) }, nil
+		} else if !os.IsExist(err) {
+			return nil, err
+		}
+		time.Sleep(dotlockInterval)
+	}
+}
@@ -7,11 +7,18 @@
 package maildir
 
 import (
+	"bufio"
+	"bytes"
+	"context"
 	"crypto/rand"
+	"encoding/base64"
 	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
+	"mime"
+	"mime/quotedprintable"
+	"net/mail"
 	"os"
 	"path/filepath"
 	"sort"
@@ -19,12 +26,14 @@ import (
 	"strings"
 	"sync/atomic"
 	"time"
+	"unicode/utf8"
 )
 
-// The separator separates a messages unique key from its flags in the filename.
-// This should only be changed on operating systems where the colon isn't
-// allowed in filenames.
-const separator rune = ':'
+// Separator separates the unique key of a message from its info section in
+// its filename. It should only be changed on filesystems which don't allow
+// colons in filenames, e.g. to ';' or '!' on Windows or VFAT, before using the
+// package: all the Maildirs accessed by a program share the same separator.
+var Separator rune = ':'
 
 // readdirChunk represents the number of files to load at once from the mailbox
 // when searching for a message
@@ -64,6 +73,43 @@ func (e *MailfileError) Error() string {
 	return "maildir: invalid mailfile format: " + e.Name
 }
 
+// A MisplacedFolderError is reported to Warning when a directory which looks
+// like a Maildir++ folder is found in cur, e.g. after a bad manual move.
+type MisplacedFolderError struct {
+	Path string
+}
+
+func (e *MisplacedFolderError) Error() string {
+	return "maildir: folder misplaced in cur: " + e.Path
+}
+
+// Warning, if set, is called with the non-fatal problems found while listing
+// messages, such as a *MisplacedFolderError. The offending entries are
+// skipped. It may be called concurrently.
+var Warning func(err error)
+
+// warnMisplacedFolder reports the entry name of cur to Warning if it is a
+// Maildir++ folder. If fi is nil, the entry is only checked if it looks like a
+// folder.
+func warnMisplacedFolder(cur, name string, fi os.FileInfo) {
+	if Warning == nil {
+		return
+	}
+	path := filepath.Join(cur, name)
+	if fi == nil {
+		if len(name) < 2 || name[0] != '.' || name == ".." {
+			return
+		}
+		var err error
+		if fi, err = os.Lstat(path); err != nil {
+			return
+		}
+	}
+	if fi.IsDir() {
+		Warning(&MisplacedFolderError{path})
+	}
+}
+
 // A Dir represents a single directory in a Maildir mailbox.
 //
 // Dir is used by programs receiving and reading messages from a Maildir. Only
@@ -96,7 +142,7 @@ func (d Dir) Unseen() ([]string, error) {
 			}
 
 			split := strings.FieldsFunc(n, func(r rune) bool {
-				return r == separator
+				return r == Separator
 			})
 			key := split[0]
 			info := "2,"
@@ -109,7 +155,7 @@ func (d Dir) Unseen() ([]string, error) {
 			keys = append(keys, key)
 
 			err := os.Rename(filepath.Join(string(d), "new", n),
-				filepath.Join(string(d), "cur", key+string(separator)+info))
+				filepath.Join(string(d), "cur", key+string(Separator)+info))
 			if err != nil {
 				return keys, err
 			}
@@ -119,6 +165,56 @@ func (d Dir) Unseen() ([]string, error) {
 	return keys, nil
 }
 
+// UnseenEntries works like Unseen, but returns an Entry for each message
+// moved to cur.
+func (d Dir) UnseenEntries() ([]Entry, error) {
+	f, err := os.Open(filepath.Join(string(d), "new"))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []Entry
+	for {
+		fis, err := f.Readdir(readdirChunk)
+		if errors.Is(err, io.EOF) || (err == nil && len(fis) == 0) {
+			break
+		} else if err != nil {
+			return entries, err
+		}
+
+		for _, fi := range fis {
+			n := fi.Name()
+			if n[0] == '.' {
+				continue
+			}
+			key, err := parseKey(n)
+			if err != nil {
+				return entries, err
+			}
+			info := "2,"
+			if i := strings.IndexRune(n, Separator); i >= 0 {
+				info = n[i+1:]
+			}
+			name := key + string(Separator) + info
+			err = os.Rename(filepath.Join(string(d), "new", n),
+				filepath.Join(string(d), "cur", name))
+			if err != nil {
+				return entries, err
+			}
+			flags, _ := parseFlags(name)
+			entries = append(entries, Entry{
+				Key:     key,
+				Flags:   flags,
+				Size:    fi.Size(),
+				ModTime: fi.ModTime(),
+			})
+		}
+	}
+
+	return entries, nil
+}
+
 // UnseenCount returns the number of messages in new without looking at them.
 func (d Dir) UnseenCount() (int, error) {
 	f, err := os.Open(filepath.Join(string(d), "new"))
@@ -146,9 +242,50 @@ func (d Dir) UnseenCount() (int, error) {
 	return c, nil
 }
 
+// TotalCount returns the number of messages in both new and cur. Only regular
+// files are counted.
+func (d Dir) TotalCount() (int, error) {
+	c := 0
+	for _, sub := range []string{"new", "cur"} {
+		n, err := d.countFiles(sub)
+		if err != nil {
+			return 0, err
+		}
+		c += n
+	}
+	return c, nil
+}
+
+// countFiles returns the number of regular files in the given subdirectory.
+func (d Dir) countFiles(sub string) (int, error) {
+	f, err := os.Open(filepath.Join(string(d), sub))
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	c := 0
+	for {
+		fis, err := f.Readdir(readdirChunk)
+		if errors.Is(err, io.EOF) || (err == nil && len(fis) == 0) {
+			break
+		} else if err != nil {
+			return 0, err
+		}
+
+		for _, fi := range fis {
+			if fi.Name()[0] != '.' && fi.Mode().IsRegular() {
+				c++
+			}
+		}
+	}
+
+	return c, nil
+}
+
 func parseKey(filename string) (string, error) {
 	split := strings.FieldsFunc(filename, func(r rune) bool {
-		return r == separator
+		return r == Separator
 	})
 
 	if len(split) == 0 {
@@ -158,9 +295,18 @@ func parseKey(filename string) (string, error) {
 	return split[0], nil
 }
 
+// trimInfo returns key without its info section, so that methods expecting a
+// key also accept a message basename, e.g. taken from a directory listing.
+func trimInfo(key string) string {
+	if i := strings.IndexRune(key, Separator); i > 0 {
+		return key[:i]
+	}
+	return key
+}
+
 // Key returns the key for the given file path.
 func (d Dir) Key(path string) (string, error) {
-	if filepath.Dir(path) != string(d) {
+	if filepath.Dir(path) != filepath.Clean(string(d)) {
 		return "", fmt.Errorf("Filepath %s belongs to a different Maildir", path)
 	}
 
@@ -168,32 +314,262 @@ func (d Dir) Key(path string) (string, error) {
 	return parseKey(filename)
 }
 
-// Keys returns a slice of valid keys to access messages by.
+// Keys returns a slice of valid keys to access messages by. Files in cur
+// without a complete info section (":2,") and Maildir++ folders misplaced in
+// cur are skipped, see completeName and Warning.
+//
+// If reading cur fails midway, which may happen on NFS, the keys read so far
+// are returned alongside an error wrapping the one returned by the
+// filesystem.
 func (d Dir) Keys() ([]string, error) {
-	f, err := os.Open(filepath.Join(string(d), "cur"))
+	cur := filepath.Join(string(d), "cur")
+	names, readErr := readdirnames(cur)
+	if readErr != nil {
+		if len(names) == 0 {
+			return nil, readErr
+		}
+		readErr = fmt.Errorf("maildir: partial listing of %s: %w", cur, readErr)
+	}
+	var keys []string
+	for _, n := range names {
+		key, ok, err := curKey(cur, n)
+		if err != nil {
+			return nil, err
+		} else if ok {
+			keys = append(keys, key)
+		}
+	}
+	return keys, readErr
+}
+
+// curKey returns the key of the entry name of cur. ok is false if the entry
+// isn't a message and must be skipped, see completeName and
+// warnMisplacedFolder.
+func curKey(cur, name string) (key string, ok bool, err error) {
+	if name[0] == '.' {
+		warnMisplacedFolder(cur, name, nil)
+		return "", false, nil
+	}
+	if !completeName(name) {
+		return "", false, nil
+	}
+	key, err = parseKey(name)
+	return key, err == nil, err
+}
+
+// completeName reports whether a filename in cur has a complete info section.
+// Files in cur are always renamed atomically, but some filesystems such as NFS
+// may briefly expose transient names, which are skipped by Keys.
+func completeName(filename string) bool {
+	i := strings.IndexRune(filename, Separator)
+	return i > 0 && strings.HasPrefix(filename[i+1:], "2,")
+}
+
+// An Entry describes a message of a Maildir.
+type Entry struct {
+	Sub     string    // the subdirectory holding the message, "new" or "cur"
+	Key     string    // the key of the message
+	Flags   []Flag    // the flags of the message, sorted in ascending order
+	Size    int64     // the size of the message file in bytes
+	ModTime time.Time // the last modification time of the message file
+}
+
+// List returns an Entry for each message in cur, reading the directory only
+// once. Callers needing the flags of many messages should prefer List over
+// calling Flags for each key. Messages with an invalid info section have nil
+// Flags.
+func (d Dir) List() ([]Entry, error) {
+	return d.list("cur", nil)
+}
+
+// AllEntries returns an Entry for each message in new and cur, e.g. to build
+// the view of a mailbox for an IMAP SELECT. Each directory is read only once.
+// Messages in new have no flags.
+func (d Dir) AllEntries() ([]Entry, error) {
+	entries, err := d.list("new", nil)
+	if err != nil {
+		return nil, err
+	}
+	return d.list("cur", entries)
+}
+
+// list appends an Entry for each message in the subdirectory sub to entries.
+func (d Dir) list(sub string, entries []Entry) ([]Entry, error) {
+	f, err := os.Open(filepath.Join(string(d), sub))
 	if err != nil {
 		return nil, err
 	}
 	defer f.Close()
-	names, err := f.Readdirnames(0)
+	fis, err := f.Readdir(0)
 	if err != nil {
 		return nil, err
 	}
-	var keys []string
+
+	for _, fi := range fis {
+		n := fi.Name()
+		if n[0] == '.' || !fi.Mode().IsRegular() {
+			if sub == "cur" {
+				warnMisplacedFolder(f.Name(), n, fi)
+			}
+			continue
+		}
+		key, err := parseKey(n)
+		if err != nil {
+			// not a message, e.g. ":", skipped like by Keys
+			continue
+		}
+		var flags []Flag
+		if sub == "cur" {
+			flags, _ = parseFlags(n)
+		}
+		entries = append(entries, Entry{
+			Sub:     sub,
+			Key:     key,
+			Flags:   flags,
+			Size:    fi.Size(),
+			ModTime: fi.ModTime(),
+		})
+	}
+	return entries, nil
+}
+
+// KeysLargerThan returns an Entry for each message in cur larger than
+// threshold bytes, largest first, e.g. to find the messages to remove to
+// free some quota. The size is taken from the S= field of the message key when
+// present, so that only the matching messages need to be stat'd.
+func (d Dir) KeysLargerThan(threshold int64) ([]Entry, error) {
+	cur := filepath.Join(string(d), "cur")
+	names, err := readdirnames(cur)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []Entry
 	for _, n := range names {
-		if n[0] != '.' {
-			key, err := parseKey(n)
+		if n[0] == '.' {
+			continue
+		}
+		key, err := parseKey(n)
+		if err != nil {
+			return nil, err
+		}
+		size, ok := keySize(key)
+		if ok && size <= threshold {
+			continue
+		}
+		fi, err := os.Stat(filepath.Join(cur, n))
+		if os.IsNotExist(err) {
+			// removed or renamed concurrently
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		if !ok {
+			size = fi.Size()
+		}
+		if size <= threshold {
+			continue
+		}
+		flags, _ := parseFlags(n)
+		entries = append(entries, Entry{
+			Sub:     "cur",
+			Key:     key,
+			Flags:   flags,
+			Size:    size,
+			ModTime: fi.ModTime(),
+		})
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].Size > entries[j].Size
+	})
+	return entries, nil
+}
+
+// KeysChan streams the keys of the messages in cur as the directory is read,
+// so that very large Maildirs can be processed with bounded memory. Entries
+// are skipped like by Keys.
+//
+// The keys channel is closed once all keys have been sent, an error occurs or
+// ctx is cancelled. The error channel then receives the error, if any, and is
+// closed as well.
+func (d Dir) KeysChan(ctx context.Context) (<-chan string, <-chan error) {
+	keys := make(chan string)
+	errs := make(chan error, 1)
+	go func() {
+		defer close(errs)
+		defer close(keys)
+		if err := d.sendKeys(ctx, keys); err != nil {
+			errs <- err
+		}
+	}()
+	return keys, errs
+}
+
+func (d Dir) sendKeys(ctx context.Context, keys chan<- string) error {
+	cur := filepath.Join(string(d), "cur")
+	f, err := os.Open(cur)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	for {
+		names, err := f.Readdirnames(readdirChunk)
+		if errors.Is(err, io.EOF) || (err == nil && len(names) == 0) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		for _, n := range names {
+			key, ok, err := curKey(cur, n)
 			if err != nil {
-				return nil, err
+				return err
+			} else if !ok {
+				continue
+			}
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			select {
+			case keys <- key:
+			case <-ctx.Done():
+				return ctx.Err()
 			}
-			keys = append(keys, key)
 		}
 	}
+}
+
+// KeysReverse returns the keys of the messages in cur sorted by delivery time,
+// newest first. Keys with the same delivery time keep the order in which they
+// are returned by Keys.
+func (d Dir) KeysReverse() ([]string, error) {
+	keys, err := d.Keys()
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(keys, func(i, j int) bool {
+		return keyTime(keys[i]) > keyTime(keys[j])
+	})
 	return keys, nil
 }
 
+// keyTime returns the delivery time encoded in the first part of a key, in
+// seconds since the epoch. Keys which don't start with a timestamp are
+// considered to be the oldest.
+func keyTime(key string) int64 {
+	if i := strings.IndexByte(key, '.'); i >= 0 {
+		key = key[:i]
+	}
+	t, err := strconv.ParseInt(key, 10, 64)
+	if err != nil {
+		return 0
+	}
+	return t
+}
+
 func (d Dir) filenameGuesses(key string) []string {
-	basename := filepath.Join(string(d), "cur", key+string(separator)+"2,")
+	basename := filepath.Join(string(d), "cur", key+string(Separator)+"2,")
 	return []string{
 		basename,
 
@@ -216,10 +592,93 @@ func (d Dir) filenameGuesses(key string) []string {
 	}
 }
 
+// testHookReaddir, if set, is called each time a directory is listed by
+// readdirnames.
+var testHookReaddir func(dir string)
+
+// Filenames resolves the paths of several keys with a single read of cur,
+// which is much cheaper than calling Filename for each key in a large
+// Maildir. The paths are returned by key; keys which don't match exactly one
+// file are reported with a *KeyError in the second map instead.
+func (d Dir) Filenames(keys []string) (map[string]string, map[string]error) {
+	paths := make(map[string]string, len(keys))
+	errs := make(map[string]error)
+
+	dir := filepath.Join(string(d), "cur")
+	names, err := readdirnames(dir)
+	if err != nil {
+		for _, key := range keys {
+			errs[key] = err
+		}
+		return paths, errs
+	}
+
+	matches := matchKeys(names)
+	for _, key := range keys {
+		if m := matches[trimInfo(key)]; len(m) == 1 {
+			paths[key] = filepath.Join(dir, m[0])
+		} else {
+			errs[key] = &KeyError{key, len(m)}
+		}
+	}
+	return paths, errs
+}
+
+// matchKeys groups the names of the message files of a directory by key.
+func matchKeys(names []string) map[string][]string {
+	matches := make(map[string][]string, len(names))
+	for _, n := range names {
+		if n[0] == '.' {
+			continue
+		}
+		key, err := parseKey(n)
+		if err != nil {
+			continue
+		}
+		matches[key] = append(matches[key], n)
+	}
+	return matches
+}
+
+// testHookReaddirResult, if set, can replace the result of each directory
+// listing done by readdirnames, e.g. to simulate a partial listing.
+var testHookReaddirResult func(dir string, names []string, err error) ([]string, error)
+
+// readdirnames returns the names of all the entries of a directory. On error,
+// the names read so far are returned alongside the error.
+func readdirnames(dir string) ([]string, error) {
+	if testHookReaddir != nil {
+		testHookReaddir(dir)
+	}
+	f, err := os.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	names, err := f.Readdirnames(0)
+	if testHookReaddirResult != nil {
+		names, err = testHookReaddirResult(dir, names, err)
+	}
+	return names, err
+}
+
 // Filename returns the path to the file corresponding to the key.
+//
+// If the key doesn't match exactly one file, a *KeyError is returned: its N
+// field is 0 if the message doesn't exist (e.g. because it has been removed
+// concurrently) and greater than 1 if several files share the same key. The
+// error is returned unchanged by all the methods looking up a message by key.
+//
+// Common flag combinations are tried first without reading the directory, in
+// which case duplicate keys are not detected.
+//
+// A message basename, including its info section, is accepted in place of the
+// key, so that all the methods looking up a message by key can be passed the
+// names found when listing cur.
 func (d Dir) Filename(key string) (string, error) {
-	// before doing an expensive Glob, see if we can guess the path based on some
-	// common flags
+	key = trimInfo(key)
+	// before reading the whole directory, see if we can guess the path based
+	// on some common flags
 	for _, guess := range d.filenameGuesses(key) {
 		if _, err := os.Stat(guess); err == nil {
 			return guess, nil
@@ -231,35 +690,280 @@ func (d Dir) Filename(key string) (string, error) {
 	}
 	defer file.Close()
 
-	// search for a valid candidate (in blocks of readdirChunk)
+	// search for all the candidates (in blocks of readdirChunk)
+	var match string
+	n := 0
 	for {
 		names, err := file.Readdirnames(readdirChunk)
-
-		// no match
-		if errors.Is(err, io.EOF) {
-			return "", &KeyError{key, 0}
+		if errors.Is(err, io.EOF) || (err == nil && len(names) == 0) {
+			break
 		}
 		if err != nil {
 			return "", err
 		}
 
 		for _, name := range names {
-			if strings.HasPrefix(name, key) {
-				return name, nil
+			// compare the whole key, not a prefix, so that a key which is
+			// a prefix of another one doesn't match both
+			if k, err := parseKey(name); err == nil && k == key {
+				match = name
+				n++
 			}
 		}
 	}
+	if n != 1 {
+		return "", &KeyError{key, n}
+	}
+	return filepath.Join(string(d), "cur", match), nil
 }
 
+// testHookOpen, if set, is called by Open between the resolution of the key
+// and the opening of the file.
+var testHookOpen func(filename string)
+
 // Open reads a message by key.
 func (d Dir) Open(key string) (io.ReadCloser, error) {
+	f, err := d.OpenFile(key)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// OpenFile opens the file of a message by key, e.g. to serve it with io.Copy,
+// which can then use sendfile or splice. The caller must close the file.
+func (d Dir) OpenFile(key string) (*os.File, error) {
 	filename, err := d.Filename(key)
 	if err != nil {
 		return nil, err
 	}
-	return os.Open(filename)
+	if testHookOpen != nil {
+		testHookOpen(filename)
+	}
+	f, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		// the file may have been renamed by a concurrent flag change since
+		// the key has been resolved
+		filename, err = d.Filename(key)
+		if err != nil {
+			return nil, err
+		}
+		f, err = os.Open(filename)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Walk calls fn for each message in cur, with its key, its flags and a
+// reader streaming its content, which is only valid during the call. Messages
+// are read one at a time and cur is listed only once, so Walk is suited to
+// Maildirs with many or large messages. Entries are skipped like by Keys, as
+// are messages removed or renamed by a concurrent flag change while walking.
+//
+// If fn returns an error, Walk stops and returns it.
+func (d Dir) Walk(fn func(key string, flags []Flag, r io.Reader) error) error {
+	cur := filepath.Join(string(d), "cur")
+	names, err := readdirnames(cur)
+	if err != nil {
+		return err
+	}
+	for _, n := range names {
+		key, ok, err := curKey(cur, n)
+		if err != nil {
+			return err
+		} else if !ok {
+			continue
+		}
+		flags, _ := parseFlags(n)
+		f, err := os.Open(filepath.Join(cur, n))
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		err = fn(key, flags, f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Message returns a message by key. The message is read into memory entirely.
+func (d Dir) Message(key string) (*mail.Message, error) {
+	rc, err := d.Open(key)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	var buf bytes.Buffer
+	if _, err := buf.ReadFrom(rc); err != nil {
+		return nil, err
+	}
+	return mail.ReadMessage(&buf)
+}
+
+// Header returns the header of a message by key. The body is not read.
+func (d Dir) Header(key string) (mail.Header, error) {
+	msg, err := d.Read(key, ReadOptions{HeaderOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	msg.Body.(io.Closer).Close()
+	return msg.Header, nil
+}
+
+// ReadOptions contains options for Dir.Read.
+type ReadOptions struct {
+	// HeaderOnly only parses the header of the message. The body is left
+	// unread: it is read from the message file as the returned message's
+	// Body is read. The Body then also implements io.Closer, and must be
+	// closed by the caller to release the file.
+	HeaderOnly bool
+}
+
+// Read returns a message by key. By default the message is read into memory
+// entirely like with Message, see ReadOptions to only parse its header.
+func (d Dir) Read(key string, opts ReadOptions) (*mail.Message, error) {
+	if !opts.HeaderOnly {
+		return d.Message(key)
+	}
+
+	rc, err := d.Open(key)
+	if err != nil {
+		return nil, err
+	}
+	msg, err := mail.ReadMessage(bufio.NewReader(rc))
+	if err != nil {
+		rc.Close()
+		return nil, err
+	}
+	msg.Body = struct {
+		io.Reader
+		io.Closer
+	}{msg.Body, rc}
+	return msg, nil
+}
+
+// ForEachMessage calls fn for each message in cur, with a reader to its
+// content. The reader is only valid until fn returns. Iteration stops at the
+// first error returned by fn, which is then returned by ForEachMessage. It is
+// equivalent to Walk, without the flags.
+func (d Dir) ForEachMessage(fn func(key string, r io.Reader) error) error {
+	return d.Walk(func(key string, flags []Flag, r io.Reader) error {
+		return fn(key, r)
+	})
+}
+
+// DecodedBody returns the body of a message by key, decoded according to its
+// Content-Transfer-Encoding header field. The base64 and quoted-printable
+// encodings are supported. The caller must close the returned reader.
+//
+// Multipart messages are returned as is: their parts have their own encoding,
+// which must be decoded separately.
+func (d Dir) DecodedBody(key string) (io.ReadCloser, error) {
+	msg, err := d.Read(key, ReadOptions{HeaderOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	body := msg.Body.(io.ReadCloser)
+
+	var r io.Reader
+	enc := strings.ToLower(strings.TrimSpace(msg.Header.Get("Content-Transfer-Encoding")))
+	switch enc {
+	case "base64":
+		r = base64.NewDecoder(base64.StdEncoding, body)
+	case "quoted-printable":
+		r = quotedprintable.NewReader(body)
+	case "", "7bit", "8bit", "binary":
+		return body, nil
+	default:
+		body.Close()
+		return nil, fmt.Errorf("maildir: unsupported Content-Transfer-Encoding %q", enc)
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{r, body}, nil
+}
+
+// Recipients returns the addresses listed in the To, Cc and Bcc header fields
+// of a message, without duplicates. Addresses which can't be parsed are
+// skipped.
+func (d Dir) Recipients(key string) ([]*mail.Address, error) {
+	h, err := d.Header(key)
+	if err != nil {
+		return nil, err
+	}
+
+	var addrs []*mail.Address
+	seen := make(map[string]bool)
+	for _, field := range []string{"To", "Cc", "Bcc"} {
+		for _, v := range h[field] {
+			for _, addr := range parseAddresses(v) {
+				if k := strings.ToLower(addr.Address); !seen[k] {
+					seen[k] = true
+					addrs = append(addrs, addr)
+				}
+			}
+		}
+	}
+	return addrs, nil
+}
+
+// parseAddresses parses an address list, skipping the invalid addresses.
+func parseAddresses(list string) []*mail.Address {
+	if addrs, err := mail.ParseAddressList(list); err == nil {
+		return addrs
+	}
+	// parse the addresses one by one, commas in quoted display names and
+	// comments may be split wrongly but only valid addresses are kept anyway
+	var addrs []*mail.Address
+	for _, s := range strings.Split(list, ",") {
+		if addr, err := mail.ParseAddress(s); err == nil {
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs
 }
 
+// DecodedHeader returns the value of a header field of a message with its
+// RFC 2047 encoded-words decoded to UTF-8, e.g. for displaying the Subject or
+// the display names of the From and To fields. Encoded-words in the UTF-8,
+// US-ASCII and ISO-8859-1 charsets are supported, and can be mixed.
+func (d Dir) DecodedHeader(key, field string) (string, error) {
+	h, err := d.Header(key)
+	if err != nil {
+		return "", err
+	}
+	var dec mime.WordDecoder
+	return dec.DecodeHeader(h.Get(field))
+}
+
+// HeaderBytes returns the header block of a message exactly as it is stored on
+// disk: folded lines are not unfolded and line endings are left untouched. The
+// blank line separating the header from the body is not included.
+//
+// This is intended for callers who need the original bytes, e.g. for DKIM
+// canonicalization.
+func (d Dir) HeaderBytes(key string) ([]byte, error) {
+	rc, err := d.Open(key)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	header, _, err := readRawHeader(bufio.NewReader(rc))
+	return header, err
+}
+
+// A Flag is a letter of the info section of a message, e.g. FlagSeen. The
+// flags of a message can be changed with Dir.SetFlags, Dir.AddFlags and
+// Dir.RemoveFlags, which keep them sorted and free of duplicates.
 type Flag rune
 
 const (
@@ -287,28 +991,189 @@ func (s flagList) Less(i, j int) bool { return s[i] < s[j] }
 
 // Flags returns the flags for a message sorted in ascending order.
 // See the documentation of SetFlags for details.
+//
+// All the letters of the info section are returned, including the lowercase
+// keyword letters used by e.g. Dovecot. Since uppercase letters sort first,
+// callers only interested in the standard flags can stop at the first
+// lowercase letter.
+//
+// The returned slice is newly allocated on each call, so callers are free to
+// modify it.
+//
+// A *FlagError is wrapped in an error mentioning the path of the message
+// file.
 func (d Dir) Flags(key string) ([]Flag, error) {
 	filename, err := d.Filename(key)
 	if err != nil {
 		return nil, err
 	}
-	split := strings.FieldsFunc(filename, func(r rune) bool {
-		return r == separator
-	})
-	switch {
-	case len(split) <= 1:
-		return nil, &MailfileError{filename}
-	case len(split[1]) < 2,
-		split[1][1] != ',':
-		return nil, &FlagError{split[1], false}
-	case split[1][0] == '1':
-		return nil, &FlagError{split[1], true}
-	case split[1][0] != '2':
-		return nil, &FlagError{split[1], false}
-	}
-	fl := flagList(split[1][2:])
-	sort.Sort(fl)
-	return []Flag(fl), nil
+	flags, err := parseFlags(filename)
+	var flagErr *FlagError
+	if errors.As(err, &flagErr) {
+		// the info section alone doesn't help to find the file
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+	return flags, err
+}
+
+// parseFlags returns the flags encoded in the info section of a message file
+// name, sorted in ascending order.
+func parseFlags(filename string) ([]Flag, error) {
+	info, ok := infoField(filepath.Base(filename))
+	switch {
+	case !ok:
+		return nil, &MailfileError{filename}
+	case len(info) < 2,
+		info[1] != ',':
+		return nil, &FlagError{info, false}
+	case info[0] == '1':
+		return nil, &FlagError{info, true}
+	case info[0] != '2':
+		return nil, &FlagError{info, false}
+	}
+
+	// a single allocation for the result, sorted in place: there are only a
+	// handful of flags, so an insertion sort is cheaper than sort.Sort
+	n := utf8.RuneCountInString(info[2:])
+	if n == 0 {
+		return []Flag{}, nil
+	}
+	flags := make([]Flag, 0, n)
+	for _, r := range info[2:] {
+		i := len(flags)
+		flags = append(flags, Flag(r))
+		for ; i > 0 && flags[i-1] > Flag(r); i-- {
+			flags[i] = flags[i-1]
+		}
+		flags[i] = Flag(r)
+	}
+	return flags, nil
+}
+
+// infoField returns the info section of a basename, i.e. the second
+// non-empty field separated by Separator, without allocating.
+func infoField(name string) (info string, ok bool) {
+	fields := 0
+	for len(name) > 0 {
+		i := strings.IndexRune(name, Separator)
+		if i != 0 {
+			if fields == 1 {
+				if i < 0 {
+					return name, true
+				}
+				return name[:i], true
+			}
+			fields++
+		}
+		if i < 0 {
+			break
+		}
+		name = name[i+utf8.RuneLen(Separator):]
+	}
+	return "", false
+}
+
+// StatsByFlag returns the total size in bytes of the messages in cur having
+// each flag. A message with several flags is accounted for each of them, and
+// messages without flags are accounted under the zero Flag. Messages with an
+// invalid info section are ignored.
+//
+// The size is taken from the S= field of the message key when present, and
+// from the file itself otherwise.
+func (d Dir) StatsByFlag() (map[Flag]int64, error) {
+	dir := filepath.Join(string(d), "cur")
+	names, err := readdirnames(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	stats := make(map[Flag]int64)
+	for _, n := range names {
+		if n[0] == '.' {
+			continue
+		}
+		flags, err := parseFlags(n)
+		if err != nil {
+			continue
+		}
+		key, err := parseKey(n)
+		if err != nil {
+			continue
+		}
+		size, ok := keySize(key)
+		if !ok {
+			fi, err := os.Stat(filepath.Join(dir, n))
+			if err != nil {
+				return nil, err
+			}
+			size = fi.Size()
+		}
+		if len(flags) == 0 {
+			stats[0] += size
+		}
+		for _, f := range flags {
+			stats[f] += size
+		}
+	}
+	return stats, nil
+}
+
+// keySize returns the message size stored in the S= field of a key, as
+// written by e.g. Dovecot and Courier.
+func keySize(key string) (int64, bool) {
+	return keyField(key, "S")
+}
+
+// keyField returns the value of a numeric ",name=value" field of a key.
+func keyField(key, name string) (int64, bool) {
+	i := strings.Index(key, ","+name+"=")
+	if i < 0 {
+		return 0, false
+	}
+	s := key[i+len(name)+2:]
+	if j := strings.IndexByte(s, ','); j >= 0 {
+		s = s[:j]
+	}
+	size, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return size, true
+}
+
+// RFC822Size returns the size of a message with CRLF line endings, as
+// expected by IMAP clients for RFC822.SIZE. It is read from the W= field of
+// the key if present, as written by Dovecot. Otherwise it is computed from
+// the message file by counting each bare LF as two bytes.
+func (d Dir) RFC822Size(key string) (int64, error) {
+	key = trimInfo(key)
+	if size, ok := keyField(key, "W"); ok {
+		return size, nil
+	}
+	f, err := d.Open(key)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	var size int64
+	var prev byte
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := f.Read(buf)
+		for _, b := range buf[:n] {
+			if b == '\n' && prev != '\r' {
+				size++
+			}
+			prev = b
+		}
+		size += int64(n)
+		if err == io.EOF {
+			return size, nil
+		} else if err != nil {
+			return 0, err
+		}
+	}
 }
 
 func formatInfo(flags []Flag) string {
@@ -326,6 +1191,10 @@ func formatInfo(flags []Flag) string {
 // SetFlags appends an info section to the filename according to the given flags.
 // This function removes duplicates and sorts the flags, but doesn't check
 // whether they conform with the Maildir specification.
+//
+// Lowercase keyword letters, as used by e.g. Dovecot, can be mixed with the
+// standard flags: they are stored after them, in ascending order, e.g.
+// "2,Sac".
 func (d Dir) SetFlags(key string, flags []Flag) error {
 	return d.SetInfo(key, formatInfo(flags))
 }
@@ -333,29 +1202,254 @@ func (d Dir) SetFlags(key string, flags []Flag) error {
 // Set the info part of the filename.
 // Only use this if you plan on using a non-standard info part.
 func (d Dir) SetInfo(key, info string) error {
+	key = trimInfo(key)
 	filename, err := d.Filename(key)
 	if err != nil {
 		return err
 	}
-	err = os.Rename(filename, filepath.Join(string(d), "cur", key+
-		string(separator)+info))
-	return err
+	newpath := filepath.Join(string(d), "cur", key+string(Separator)+info)
+	restore, err := makeWritable(filename)
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(filename, newpath); err != nil {
+		restore(filename)
+		return err
+	}
+	restore(newpath)
+	return nil
+}
+
+// changeFlags adds and removes flags of a message, keeping its other flags.
+func (d Dir) changeFlags(key string, add, remove []Flag) error {
+	flags, err := d.Flags(key)
+	if err != nil {
+		return err
+	}
+	var changed []Flag
+	for _, f := range append(flags, add...) {
+		if !hasFlag(remove, f) {
+			changed = append(changed, f)
+		}
+	}
+	return d.SetFlags(key, changed)
+}
+
+// AddFlags adds flags to a message, keeping its other flags. Flags which are
+// already set are left untouched.
+func (d Dir) AddFlags(key string, flags ...Flag) error {
+	return d.changeFlags(key, flags, nil)
+}
+
+// RemoveFlags removes flags from a message, keeping its other flags. Flags
+// which aren't set are ignored.
+func (d Dir) RemoveFlags(key string, flags ...Flag) error {
+	return d.changeFlags(key, nil, flags)
+}
+
+// hasFlag checks whether flags contains f.
+func hasFlag(flags []Flag, f Flag) bool {
+	for _, flag := range flags {
+		if flag == f {
+			return true
+		}
+	}
+	return false
+}
+
+// MarkSeen adds FlagSeen to a message. If the message is still in new, it is
+// moved to cur first.
+func (d Dir) MarkSeen(key string) error {
+	key = trimInfo(key)
+	if err := d.moveFromNew(key); err != nil {
+		return err
+	}
+	return d.changeFlags(key, []Flag{FlagSeen}, nil)
+}
+
+// MarkUnseen removes FlagSeen from a message.
+func (d Dir) MarkUnseen(key string) error {
+	return d.changeFlags(key, nil, []Flag{FlagSeen})
+}
+
+// IsRecent reports whether a message is still in new, i.e. hasn't been seen
+// by any client yet. This is what IMAP servers report as the \Recent flag.
+// Both messages in cur and unknown keys are reported as not recent.
+func (d Dir) IsRecent(key string) (bool, error) {
+	key = trimInfo(key)
+	names, err := readdirnames(filepath.Join(string(d), "new"))
+	if err != nil {
+		return false, err
+	}
+	for _, n := range names {
+		if k, err := parseKey(n); err == nil && k == key {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// moveFromNew moves a message from new to cur, like Unseen does. Nothing is
+// done if the message isn't in new.
+func (d Dir) moveFromNew(key string) error {
+	key = trimInfo(key)
+	names, err := readdirnames(filepath.Join(string(d), "new"))
+	if err != nil {
+		return err
+	}
+	for _, n := range names {
+		k, err := parseKey(n)
+		if err != nil || k != key {
+			continue
+		}
+		info := "2,"
+		if i := strings.IndexRune(n, Separator); i >= 0 {
+			info = n[i+1:]
+		}
+		return os.Rename(filepath.Join(string(d), "new", n),
+			filepath.Join(string(d), "cur", key+string(Separator)+info))
+	}
+	return nil
+}
+
+// RenameInNew changes the key of a message in new without moving it to cur,
+// e.g. to resolve a key collision while importing messages, and returns the
+// new key. The message is given the desired key if it's free, and a freshly
+// generated key otherwise.
+func (d Dir) RenameInNew(oldKey, desired string) (string, error) {
+	dir := filepath.Join(string(d), "new")
+	names, err := readdirnames(dir)
+	if err != nil {
+		return "", err
+	}
+	var name string
+	n := 0
+	for _, nm := range names {
+		if k, err := parseKey(nm); err == nil && k == oldKey {
+			name = nm
+			n++
+		}
+	}
+	if n != 1 {
+		return "", &KeyError{oldKey, n}
+	}
+	oldpath := filepath.Join(dir, name)
+	suffix := name[len(oldKey):]
+
+	key := desired
+	for i := 0; ; i++ {
+		if key != "" && key != oldKey {
+			// the key must not be used in cur either
+			_, err := d.Filename(key)
+			var keyErr *KeyError
+			if errors.As(err, &keyErr) && keyErr.N == 0 {
+				// linking doesn't replace an existing file, unlike renaming
+				err = os.Link(oldpath, filepath.Join(dir, key+suffix))
+				if err == nil {
+					return key, os.Remove(oldpath)
+				} else if !os.IsExist(err) {
+					return "", err
+				}
+			} else if keyErr == nil && err != nil {
+				return "", err
+			}
+		}
+		if i >= maxKeyRetries {
+			return "", &KeyError{key, 1}
+		}
+		if key, err = newKey(); err != nil {
+			return "", err
+		}
+	}
+}
+
+// CheckFlagOrder returns the keys of the messages in cur whose flags aren't
+// sorted in ascending order, as required by the Maildir specification. Such
+// messages can be fixed with FixFlagOrder.
+func (d Dir) CheckFlagOrder() ([]string, error) {
+	unsorted, err := d.unsortedFlags()
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]string, 0, len(unsorted))
+	for key := range unsorted {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// FixFlagOrder renames the messages in cur whose flags aren't sorted, and
+// returns the number of renamed messages.
+func (d Dir) FixFlagOrder() (int, error) {
+	unsorted, err := d.unsortedFlags()
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for key, name := range unsorted {
+		flags, err := parseFlags(name)
+		if err != nil {
+			return n, err
+		}
+		err = os.Rename(filepath.Join(string(d), "cur", name),
+			filepath.Join(string(d), "cur", key+string(Separator)+formatInfo(flags)))
+		if err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+// unsortedFlags returns the file names of the messages in cur whose flags
+// aren't sorted, by key.
+func (d Dir) unsortedFlags() (map[string]string, error) {
+	names, err := readdirnames(filepath.Join(string(d), "cur"))
+	if err != nil {
+		return nil, err
+	}
+	unsorted := make(map[string]string)
+	for _, n := range names {
+		if n[0] == '.' {
+			continue
+		}
+		flags, err := parseFlags(n)
+		if err != nil {
+			continue
+		}
+		key, err := parseKey(n)
+		if err != nil {
+			continue
+		}
+		if !strings.HasSuffix(n, string(Separator)+formatInfo(flags)) {
+			unsorted[key] = n
+		}
+	}
+	return unsorted, nil
 }
 
+// testHookNewKey, if set, is called by newKey. If it returns a non-empty
+// string, it is used as the new key.
+var testHookNewKey func() string
+
 // newKey generates a new unique key as described in the Maildir specification.
 // For the third part of the key (delivery identifier) it uses an internal
 // counter, the process id and a cryptographical random number to ensure
 // uniqueness among messages delivered in the same second.
 func newKey() (string, error) {
+	if testHookNewKey != nil {
+		if key := testHookNewKey(); key != "" {
+			return key, nil
+		}
+	}
 	var key string
 	key += strconv.FormatInt(time.Now().Unix(), 10)
 	key += "."
-	host, err := os.Hostname()
+	host, err := keyHostname()
 	if err != nil {
 		return "", err
 	}
-	host = strings.Replace(host, "/", "\057", -1)
-	host = strings.Replace(host, string(separator), "\072", -1)
 	key += host
 	key += "."
 	key += strconv.FormatInt(int64(os.Getpid()), 10)
@@ -370,6 +1464,61 @@ func newKey() (string, error) {
 	return key, nil
 }
 
+// testHookHostname, if set, replaces os.Hostname in keyHostname.
+var testHookHostname func() (string, error)
+
+// keyHostname returns the hostname of the machine, as used in keys. '/', '\'
+// and Separator are replaced with '_' followed by their octal code, e.g. "_057"
+// for '/'. The Maildir specification escapes them with '\' instead, which
+// isn't valid in Windows filenames.
+func keyHostname() (string, error) {
+	hostname := os.Hostname
+	if testHookHostname != nil {
+		hostname = testHookHostname
+	}
+	host, err := hostname()
+	if err != nil {
+		return "", err
+	}
+	var sb strings.Builder
+	for _, r := range host {
+		if r == '/' || r == '\\' || r == Separator {
+			fmt.Fprintf(&sb, "_%03o", r)
+		} else {
+			sb.WriteRune(r)
+		}
+	}
+	return sb.String(), nil
+}
+
+// writeFileAtomic replaces the file name in the root of d with data. The data
+// is first written to tmp and then renamed into place.
+func writeFileAtomic(d Dir, name string, data []byte) error {
+	key, err := newKey()
+	if err != nil {
+		return err
+	}
+	tmppath := filepath.Join(string(d), "tmp", key)
+	f, err := os.OpenFile(tmppath, os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmppath, filepath.Join(string(d), name))
+	}
+	if err != nil {
+		os.Remove(tmppath)
+	}
+	return err
+}
+
 // Init creates the directory structure for a Maildir.
 //
 // If the main directory already exists, it tries to create the subdirectories
@@ -395,13 +1544,168 @@ func (d Dir) Init() error {
 	return nil
 }
 
-// Move moves a message from this Maildir to another.
-func (d Dir) Move(target Dir, key string) error {
+// testHookLink, if set, replaces os.Link in Move and MoveBatch, e.g. to
+// simulate a cross-device move.
+var testHookLink func(oldpath, newpath string) error
+
+// Move moves a message from this Maildir to the cur directory of another,
+// keeping its info section, and returns its key in the target. The key is
+// kept unless the target already has a file with the same name, in which case
+// a new key is generated. The target directory isn't read, so a message of
+// the target with the same key but other flags isn't detected, see MoveBatch.
+//
+// If the Maildirs are on different filesystems, the message is copied to the
+// target and then removed. A message which is concurrently moved from new to
+// cur or whose flags are changed is still found.
+func (d Dir) Move(target Dir, key string) (string, error) {
+	key = trimInfo(key)
+	var targetKey string
+	err := d.withFilename(key, func(path string) error {
+		var err error
+		targetKey, err = moveFile(path, key, target, key, func(string) error {
+			// the message may have been renamed while it was linked or
+			// copied
+			return d.withFilename(key, os.Remove)
+		})
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	return targetKey, nil
+}
+
+// moveFile moves the message file path with the given key to cur of target,
+// keeping its info section, and returns its key there: targetKey, or a new key
+// if target already has a file with the resulting name. The file is linked
+// into target, or copied if target is on another filesystem, and then removed
+// with remove.
+func moveFile(path, key string, target Dir, targetKey string, remove func(path string) error) (string, error) {
+	link := os.Link
+	if testHookLink != nil {
+		link = testHookLink
+	}
+	info := filepath.Base(path)[len(key):]
+	src := path
+	for i := 0; ; i++ {
+		err := link(src, filepath.Join(string(target), "cur", targetKey+info))
+		if isCrossDevice(err) && src == path {
+			tmppath := filepath.Join(string(target), "tmp", targetKey)
+			if err := copyFile(path, tmppath); err != nil {
+				os.Remove(tmppath)
+				return "", err
+			}
+			defer os.Remove(tmppath)
+			src = tmppath
+			continue
+		}
+		if os.IsExist(err) && i < maxKeyRetries {
+			if targetKey, err = newKey(); err == nil {
+				continue
+			}
+		}
+		if err != nil {
+			return "", err
+		}
+		break
+	}
+	return targetKey, remove(path)
+}
+
+// withFilename calls fn with the path of the message with the given key. If
+// the file doesn't exist anymore, because the message has been concurrently
+// renamed by a flag change or moved from new to cur, the path is resolved and
+// fn called again.
+func (d Dir) withFilename(key string, fn func(filename string) error) error {
+	key = trimInfo(key)
 	path, err := d.Filename(key)
+	if isNotFound(err) {
+		if err := d.moveFromNew(key); err != nil {
+			return err
+		}
+		path, err = d.Filename(key)
+	}
 	if err != nil {
 		return err
 	}
-	return os.Rename(path, filepath.Join(string(target), "cur", filepath.Base(path)))
+	if err := fn(path); !os.IsNotExist(err) {
+		return err
+	}
+	if path, err = d.Filename(key); err != nil {
+		return err
+	}
+	return fn(path)
+}
+
+// isNotFound reports whether err is a *KeyError for a missing message.
+func isNotFound(err error) bool {
+	var keyErr *KeyError
+	return errors.As(err, &keyErr) && keyErr.N == 0
+}
+
+// isCrossDevice reports whether err is caused by a rename across
+// filesystems.
+func isCrossDevice(err error) bool {
+	var linkErr *os.LinkError
+	return errors.As(err, &linkErr) && linkErr.Err == errCrossDevice
+}
+
+// MoveBatch moves several messages from this Maildir to another, reading the
+// source and target directories only once. Unlike with Move, messages keep
+// their key unless it is used by any message of the target, and like with
+// Move, they are copied if the target is on another filesystem: the first
+// returned map associates the key of each moved message to its key in the
+// target. Messages which couldn't be moved are reported in the second map.
+func (d Dir) MoveBatch(keys []string, target Dir) (map[string]string, map[string]error) {
+	paths, errs := d.Filenames(keys)
+	moved := make(map[string]string, len(paths))
+	used, err := target.usedKeys()
+	if err != nil {
+		for key := range paths {
+			errs[key] = err
+		}
+		return moved, errs
+	}
+	for key, path := range paths {
+		targetKey := trimInfo(key)
+		var err error
+		if used[targetKey] {
+			targetKey, err = newKey()
+		}
+		if err == nil {
+			targetKey, err = moveFile(path, trimInfo(key), target, targetKey, func(string) error {
+				return d.withFilename(key, os.Remove)
+			})
+		}
+		if os.IsNotExist(err) {
+			// renamed since cur has been read, e.g. by a flag change
+			targetKey, err = d.Move(target, key)
+		}
+		if err != nil {
+			errs[key] = err
+			continue
+		}
+		moved[key] = targetKey
+		used[targetKey] = true
+	}
+	return moved, errs
+}
+
+// usedKeys returns the keys of the messages in new and cur.
+func (d Dir) usedKeys() (map[string]bool, error) {
+	used := make(map[string]bool)
+	for _, sub := range []string{"new", "cur"} {
+		names, err := readdirnames(filepath.Join(string(d), sub))
+		if err != nil {
+			return nil, err
+		}
+		for _, n := range names {
+			if key, err := parseKey(n); err == nil {
+				used[key] = true
+			}
+		}
+	}
+	return used, nil
 }
 
 // Copy copies the message with key from this Maildir to the target, preserving
@@ -417,7 +1721,7 @@ func (d Dir) Copy(target Dir, key string) (string, error) {
 		return "", err
 	}
 	tmpfile := filepath.Join(string(target), "tmp", targetKey)
-	curfile := filepath.Join(string(target), "cur", targetKey+string(separator)+"2,")
+	curfile := filepath.Join(string(target), "cur", targetKey+string(Separator)+"2,")
 	if err = os.Rename(tmpfile, curfile); err != nil {
 		return "", err
 	}
@@ -458,7 +1762,7 @@ func (d Dir) Create(flags []Flag) (key string, w io.WriteCloser, err error) {
 	if err != nil {
 		return "", nil, err
 	}
-	basename := key + string(separator) + formatInfo(flags)
+	basename := key + string(Separator) + formatInfo(flags)
 	filename := filepath.Join(string(d), "cur", basename)
 	w, err = os.OpenFile(filename, os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0666)
 	if err != nil {
@@ -467,101 +1771,145 @@ func (d Dir) Create(flags []Flag) (key string, w io.WriteCloser, err error) {
 	return key, w, err
 }
 
-// Remove removes the actual file behind this message.
+// Remove removes the actual file behind this message. A *KeyError is returned
+// if the key doesn't match exactly one message. Like Move, Remove is safe to
+// use while the message is concurrently moved from new to cur.
+//
+// The message is also removed from the sidecar files of the Maildir root which
+// reference messages by key: the checksums and modification sequences stored
+// by this package, and Dovecot's UID list, which is updated under Dovecot's
+// lock. Since the message is already gone by then, failing to update them
+// isn't an error: a *SidecarError is reported to Warning instead. Likewise, the
+// removal is recorded in the Maildir++ maildirsize file, if any.
 func (d Dir) Remove(key string) error {
-	f, err := d.Filename(key)
+	key = trimInfo(key)
+	size, err := d.removeFile(key)
 	if err != nil {
 		return err
 	}
-	return os.Remove(f)
+	d.forgetKeys([]string{key})
+	d.removeQuotaUsage(size, 1)
+	return nil
 }
 
-// Clean removes old files from tmp and should be run periodically.
-// This does not use access time but modification time for portability reasons.
-func (d Dir) Clean() error {
-	f, err := os.Open(filepath.Join(string(d), "tmp"))
-	if err != nil {
-		return err
-	}
-	defer f.Close()
-	names, err := f.Readdirnames(0)
-	if err != nil {
-		return err
-	}
-	now := time.Now()
-	for _, n := range names {
-		fi, err := os.Stat(filepath.Join(string(d), "tmp", n))
-		if err != nil {
-			continue
-		}
-		if now.Sub(fi.ModTime()).Hours() > 36 {
-			err = os.Remove(filepath.Join(string(d), "tmp", n))
+// removeFile removes the file of the message with key, leaving the sidecar
+// files untouched, and returns its size as accounted for by the Maildir++
+// quota.
+func (d Dir) removeFile(key string) (size int64, err error) {
+	err = d.withFilename(key, func(filename string) error {
+		var ok bool
+		if size, ok = keySize(key); !ok {
+			fi, err := os.Lstat(filename)
 			if err != nil {
 				return err
 			}
+			size = fi.Size()
 		}
-	}
-	return nil
+		restore, err := makeWritable(filename)
+		if err != nil {
+			return err
+		}
+		if err := os.Remove(filename); err != nil {
+			restore(filename)
+			return err
+		}
+		return nil
+	})
+	return size, err
 }
 
-// Delivery represents an ongoing message delivery to the mailbox. It
-// implements the io.WriteCloser interface. On Close the underlying file is
-// moved/relinked to new.
-//
-// Multiple processes can perform a delivery on the same Maildir concurrently.
-type Delivery struct {
-	file *os.File
-	d    Dir
-	key  string
+// Trash marks a message as trashed, so that it is removed by the next call to
+// Purge. This is the equivalent of the IMAP \Deleted flag.
+func (d Dir) Trash(key string) error {
+	return d.AddFlags(key, FlagTrashed)
 }
 
-// NewDelivery creates a new Delivery.
-func NewDelivery(d string) (*Delivery, error) {
-	key, err := newKey()
+// Purge removes all the messages of cur flagged as trashed, e.g. to implement
+// the IMAP EXPUNGE command, and returns their keys. If an error occurs, the
+// keys of the messages removed so far are returned along with the error.
+//
+// Like with Remove, the messages are removed from the sidecar files of the
+// Maildir root, which are rewritten only once, and from the maildirsize file.
+func (d Dir) Purge() ([]string, error) {
+	entries, err := d.List()
 	if err != nil {
 		return nil, err
 	}
-	del := &Delivery{}
-	filename := filepath.Join(d, "tmp", key)
-	file, err := os.OpenFile(filename, os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0666)
-	if err != nil {
-		return nil, err
+	var keys []string
+	var total int64
+	for _, e := range entries {
+		if !hasFlag(e.Flags, FlagTrashed) {
+			continue
+		}
+		var size int64
+		if size, err = d.removeFile(e.Key); err != nil {
+			break
+		}
+		keys = append(keys, e.Key)
+		total += size
 	}
-	del.file = file
-	del.d = Dir(d)
-	del.key = key
-	return del, nil
+	d.forgetKeys(keys)
+	d.removeQuotaUsage(total, int64(len(keys)))
+	return keys, err
 }
 
-// Write implements io.Writer.
-func (d *Delivery) Write(p []byte) (int, error) {
-	return d.file.Write(p)
+// A TmpEntry describes a file in tmp, i.e. a pending or abandoned delivery.
+type TmpEntry struct {
+	Name    string    // the name of the file in tmp
+	Size    int64     // the size of the file in bytes
+	ModTime time.Time // the last modification time of the file
 }
 
-// Close closes the underlying file and moves it to new.
-func (d *Delivery) Close() error {
-	tmppath := d.file.Name()
-	err := d.file.Close()
+// ListTmp returns the files currently in tmp. This can be used to inspect
+// pending and abandoned deliveries before calling Clean.
+func (d Dir) ListTmp() ([]TmpEntry, error) {
+	f, err := os.Open(filepath.Join(string(d), "tmp"))
 	if err != nil {
-		return err
+		return nil, err
 	}
-	err = os.Link(tmppath, filepath.Join(string(d.d), "new", d.key))
+	defer f.Close()
+	fis, err := f.Readdir(0)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	err = os.Remove(tmppath)
-	if err != nil {
-		return err
+	var entries []TmpEntry
+	for _, fi := range fis {
+		if !fi.Mode().IsRegular() {
+			continue
+		}
+		entries = append(entries, TmpEntry{
+			Name:    fi.Name(),
+			Size:    fi.Size(),
+			ModTime: fi.ModTime(),
+		})
 	}
-	return nil
+	return entries, nil
 }
 
-// Abort closes the underlying file and removes it completely.
-func (d *Delivery) Abort() error {
-	tmppath := d.file.Name()
-	err := d.file.Close()
+// Clean removes old files from tmp and should be run periodically.
+// This does not use access time but modification time for portability reasons.
+func (d Dir) Clean() error {
+	f, err := os.Open(filepath.Join(string(d), "tmp"))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	names, err := f.Readdirnames(0)
 	if err != nil {
 		return err
 	}
-	return os.Remove(tmppath)
+	now := time.Now()
+	for _, n := range names {
+		fi, err := os.Stat(filepath.Join(string(d), "tmp", n))
+		if err != nil {
+			continue
+		}
+		if now.Sub(fi.ModTime()).Hours() > 36 {
+			err = os.Remove(filepath.Join(string(d), "tmp", n))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
 }
@@ -1,14 +1,21 @@
 package maildir
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"math/rand"
 	"os"
 	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
 	"sync"
 	"testing"
+	"time"
 )
 
 // cleanup removes a Dir's directory structure
@@ -230,7 +237,7 @@ func TestMove(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	err = d1.Move(d2, keys[0])
+	_, err = d1.Move(d2, keys[0])
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -498,3 +505,2175 @@ func BenchmarkFilename(b *testing.B) {
 		}
 	}
 }
+
+func TestDir_HeaderBytes(t *testing.T) {
+	t.Parallel()
+
+	d := Dir(t.TempDir())
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	const header = "From: alice@example.org\r\n" +
+		"Subject: a folded\r\n" +
+		"\t  subject line\r\n" +
+		"DKIM-Signature: v=1;  a=rsa-sha256;\r\n" +
+		" b=abc\r\n"
+	const msg = header + "\r\n" + "the body\r\n\r\nwith a blank line\r\n"
+
+	key, w, err := d.Create(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.WriteString(w, msg); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := d.HeaderBytes(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != header {
+		t.Errorf("Dir.HeaderBytes() = %q, want %q", b, header)
+	}
+}
+
+func TestDir_TotalCount(t *testing.T) {
+	t.Parallel()
+
+	d := Dir(t.TempDir())
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		makeDelivery(t, d, fmt.Sprintf("message in cur %d", i))
+	}
+	if _, err := d.Unseen(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		makeDelivery(t, d, fmt.Sprintf("message in new %d", i))
+	}
+
+	// neither directories nor dot files are messages
+	if err := os.Mkdir(filepath.Join(string(d), "cur", "subdir"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(string(d), "new", ".hidden"), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := d.TotalCount()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 5 {
+		t.Errorf("Dir.TotalCount() = %v, want 5", n)
+	}
+}
+
+func TestDir_ListTmp(t *testing.T) {
+	t.Parallel()
+
+	d := Dir(t.TempDir())
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	old := time.Now().Add(-48 * time.Hour).Truncate(time.Second)
+	files := map[string]string{
+		"pending":   "a pending delivery",
+		"abandoned": "an abandoned delivery",
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(string(d), "tmp", name), []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Chtimes(filepath.Join(string(d), "tmp", "abandoned"), old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := d.ListTmp()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != len(files) {
+		t.Fatalf("Dir.ListTmp() returned %v entries, want %v", len(entries), len(files))
+	}
+	for _, entry := range entries {
+		content, ok := files[entry.Name]
+		if !ok {
+			t.Errorf("unexpected entry %q", entry.Name)
+			continue
+		}
+		if entry.Size != int64(len(content)) {
+			t.Errorf("entry %q has size %v, want %v", entry.Name, entry.Size, len(content))
+		}
+		if entry.Name == "abandoned" && !entry.ModTime.Equal(old) {
+			t.Errorf("entry %q has mtime %v, want %v", entry.Name, entry.ModTime, old)
+		}
+	}
+}
+
+func TestDir_KeysReverse(t *testing.T) {
+	t.Parallel()
+
+	d := Dir(t.TempDir())
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []string{
+		"1600000100.M2.host",
+		"1600000000.M1.host",
+		"1600000200.M1.host",
+		"1600000100.M1.host",
+	} {
+		path := filepath.Join(string(d), "cur", key+string(Separator)+"2,")
+		if err := ioutil.WriteFile(path, nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	keys, err := d.Keys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	reversed, err := d.KeysReverse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reversed) != len(keys) {
+		t.Fatalf("Dir.KeysReverse() returned %v keys, want %v", len(reversed), len(keys))
+	}
+	for i := 1; i < len(reversed); i++ {
+		if keyTime(reversed[i-1]) < keyTime(reversed[i]) {
+			t.Errorf("Dir.KeysReverse() = %v, not sorted newest first", reversed)
+		}
+	}
+
+	// keys with equal timestamps keep their relative order from Keys
+	var equal []string
+	for _, key := range keys {
+		if keyTime(key) == 1600000100 {
+			equal = append(equal, key)
+		}
+	}
+	if reversed[1] != equal[0] || reversed[2] != equal[1] {
+		t.Errorf("Dir.KeysReverse() = %v, want %v in the middle", reversed, equal)
+	}
+}
+
+func TestKeyErrorPropagation(t *testing.T) {
+	t.Parallel()
+
+	d := Dir(t.TempDir())
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	// flag combinations which aren't guessed, so the directory is read
+	const dup = "1600000000.M1.host"
+	for _, info := range []string{"2,T", "2,DT"} {
+		path := filepath.Join(string(d), "cur", dup+string(Separator)+info)
+		if err := ioutil.WriteFile(path, []byte("Subject: dup\r\n\r\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	lookups := map[string]func(key string) error{
+		"Flags": func(key string) error {
+			_, err := d.Flags(key)
+			return err
+		},
+		"Header": func(key string) error {
+			_, err := d.Header(key)
+			return err
+		},
+		"Message": func(key string) error {
+			_, err := d.Message(key)
+			return err
+		},
+	}
+	for name, lookup := range lookups {
+		for key, n := range map[string]int{"1600000000.M2.host": 0, dup: 2} {
+			var keyErr *KeyError
+			if err := lookup(key); !errors.As(err, &keyErr) {
+				t.Errorf("Dir.%v(%q) = %v, want a *KeyError", name, key, err)
+			} else if keyErr.N != n {
+				t.Errorf("Dir.%v(%q) = %v, want N = %v", name, key, err, n)
+			}
+		}
+	}
+}
+
+func TestDir_MoveBatch(t *testing.T) {
+	// don't run this test in // as it sets a package variable
+	src := Dir(t.TempDir())
+	dst := Dir(t.TempDir())
+	for _, d := range []Dir{src, dst} {
+		if err := d.Init(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i := 0; i < 20; i++ {
+		makeDelivery(t, src, fmt.Sprintf("here is message number %d", i))
+	}
+	keys, err := src.Unseen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	const missing = "1600000000.M0.host"
+
+	scans := 0
+	testHookReaddir = func(dir string) {
+		if dir == filepath.Join(string(src), "cur") {
+			scans++
+		}
+	}
+	defer func() {
+		testHookReaddir = nil
+	}()
+
+	moved, errs := src.MoveBatch(append(keys, missing), dst)
+	if scans != 1 {
+		t.Errorf("source directory read %v times, want 1", scans)
+	}
+	if len(moved) != len(keys) {
+		t.Errorf("Dir.MoveBatch() moved %v messages, want %v", len(moved), len(keys))
+	}
+	for _, key := range keys {
+		if moved[key] != key {
+			t.Errorf("key %q mapped to %q", key, moved[key])
+		}
+		if _, err := dst.Filename(moved[key]); err != nil {
+			t.Error(err)
+		}
+	}
+	if len(errs) != 1 {
+		t.Errorf("Dir.MoveBatch() returned errors %v, want one", errs)
+	}
+	var keyErr *KeyError
+	if !errors.As(errs[missing], &keyErr) || keyErr.N != 0 {
+		t.Errorf("error for missing key = %v, want a *KeyError", errs[missing])
+	}
+}
+
+func TestDir_Open_ConcurrentRename(t *testing.T) {
+	// don't run this test in // as it sets a package variable
+	d := Dir(t.TempDir())
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+	const msg = "a renamed message"
+	makeDelivery(t, d, msg)
+	keys, err := d.Unseen()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	renamed := false
+	testHookOpen = func(filename string) {
+		if renamed {
+			return
+		}
+		renamed = true
+		if err := d.SetFlags(keys[0], []Flag{FlagSeen}); err != nil {
+			t.Error(err)
+		}
+	}
+	defer func() {
+		testHookOpen = nil
+	}()
+
+	rc, err := d.Open(keys[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	b, err := ioutil.ReadAll(rc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !renamed {
+		t.Error("message wasn't renamed")
+	}
+	if string(b) != msg {
+		t.Error("Content doesn't match")
+	}
+}
+
+func TestDir_StatsByFlag(t *testing.T) {
+	t.Parallel()
+
+	d := Dir(t.TempDir())
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, content := range map[string]string{
+		// the size is read from S= and not from the content
+		"1600000000.M1.host,S=1000:2,ST": "",
+		"1600000001.M2.host:2,T":         "0123456789",
+		"1600000002.M3.host:2,S":         "01234",
+		"1600000003.M4.host:2,":          "012",
+		"1600000004.M5.host:1,invalid":   "0123456789",
+	} {
+		name = strings.Replace(name, ":", string(Separator), 1)
+		if err := ioutil.WriteFile(filepath.Join(string(d), "cur", name), []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	stats, err := d.StatsByFlag()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[Flag]int64{
+		FlagTrashed: 1010,
+		FlagSeen:    1005,
+		0:           3,
+	}
+	if len(stats) != len(want) {
+		t.Errorf("Dir.StatsByFlag() = %v, want %v", stats, want)
+	}
+	for flag, size := range want {
+		if stats[flag] != size {
+			t.Errorf("Dir.StatsByFlag()[%q] = %v, want %v", flag, stats[flag], size)
+		}
+	}
+}
+
+func TestDir_ForEachMessage(t *testing.T) {
+	t.Parallel()
+
+	d := Dir(t.TempDir())
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+	total := 0
+	for i := 0; i < 5; i++ {
+		msg := fmt.Sprintf("here is message number %d", i*100)
+		total += len(msg)
+		makeDelivery(t, d, msg)
+	}
+	keys, err := d.Unseen()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	visited := make(map[string]bool)
+	sum := 0
+	err = d.ForEachMessage(func(key string, r io.Reader) error {
+		b, err := ioutil.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		visited[key] = true
+		sum += len(b)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sum != total {
+		t.Errorf("read %v bytes, want %v", sum, total)
+	}
+	for _, key := range keys {
+		if !visited[key] {
+			t.Errorf("message %q not visited", key)
+		}
+	}
+
+	errStop := errors.New("stop")
+	calls := 0
+	err = d.ForEachMessage(func(key string, r io.Reader) error {
+		calls++
+		return errStop
+	})
+	if err != errStop || calls != 1 {
+		t.Errorf("Dir.ForEachMessage() = %v after %v calls, want %v after 1 call", err, calls, errStop)
+	}
+}
+
+func TestDir_Read(t *testing.T) {
+	t.Parallel()
+
+	d := Dir(t.TempDir())
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+	const body = "the body\r\n"
+	key, err := d.Deliver(strings.NewReader("Subject: read me\r\n\r\n"+body), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Unseen(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, opts := range []ReadOptions{{}, {HeaderOnly: true}} {
+		msg, err := d.Read(key, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s := msg.Header.Get("Subject"); s != "read me" {
+			t.Errorf("Subject = %q, want %q", s, "read me")
+		}
+		b, err := ioutil.ReadAll(msg.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != body {
+			t.Errorf("Body = %q, want %q", b, body)
+		}
+
+		c, ok := msg.Body.(io.Closer)
+		if opts.HeaderOnly != ok {
+			t.Errorf("Body implements io.Closer: %v, want %v", ok, opts.HeaderOnly)
+		}
+		if ok {
+			if err := c.Close(); err != nil {
+				t.Error(err)
+			}
+		}
+	}
+}
+
+func TestDir_KeysChan(t *testing.T) {
+	t.Parallel()
+
+	d := Dir(t.TempDir())
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		makeDelivery(t, d, fmt.Sprintf("here is message number %d", i))
+	}
+	keys, err := d.Unseen()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ch, errs := d.KeysChan(context.Background())
+	seen := make(map[string]bool)
+	for key := range ch {
+		seen[key] = true
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range keys {
+		if !seen[key] {
+			t.Errorf("key %q not streamed", key)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ch, errs = d.KeysChan(ctx)
+	<-ch
+	cancel()
+	n := 1
+	for range ch {
+		n++
+	}
+	if err := <-errs; err != context.Canceled {
+		t.Errorf("error after cancellation = %v, want %v", err, context.Canceled)
+	}
+	if n >= len(keys) {
+		t.Errorf("received %v keys after cancellation, want less than %v", n, len(keys))
+	}
+}
+
+func TestDir_Flags_Keywords(t *testing.T) {
+	t.Parallel()
+
+	d := Dir(t.TempDir())
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+	const key = "1600000000.M1.host"
+	path := filepath.Join(string(d), "cur", key+string(Separator)+"2,bSa")
+	if err := ioutil.WriteFile(path, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	flags, err := d.Flags(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Flag{FlagSeen, 'a', 'b'}
+	if string(flagsRunes(flags)) != string(flagsRunes(want)) {
+		t.Errorf("Dir.Flags() = %q, want %q", flagsRunes(flags), flagsRunes(want))
+	}
+}
+
+// flagsRunes converts flags to runes, for comparison and printing.
+func flagsRunes(flags []Flag) []rune {
+	runes := make([]rune, len(flags))
+	for i, f := range flags {
+		runes[i] = rune(f)
+	}
+	return runes
+}
+
+func TestDir_DecodedBody(t *testing.T) {
+	t.Parallel()
+
+	d := Dir(t.TempDir())
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		encoding, body, want string
+	}{
+		{"base64", "aGVsbG8gd29y\r\nbGQgIQ==\r\n", "hello world !"},
+		{"Quoted-Printable", "caf=C3=A9 au =\r\nlait\r\n", "café au lait\r\n"},
+		{"7bit", "plain text\r\n", "plain text\r\n"},
+	} {
+		msg := "Content-Transfer-Encoding: " + tc.encoding + "\r\n\r\n" + tc.body
+		key, err := d.Deliver(strings.NewReader(msg), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := d.Unseen(); err != nil {
+			t.Fatal(err)
+		}
+
+		rc, err := d.DecodedBody(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != tc.want {
+			t.Errorf("Dir.DecodedBody() with %v = %q, want %q", tc.encoding, b, tc.want)
+		}
+	}
+}
+
+func TestDir_FixFlagOrder(t *testing.T) {
+	t.Parallel()
+
+	d := Dir(t.TempDir())
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+	const sorted, unsorted = "1600000000.M1.host", "1600000000.M2.host"
+	for _, name := range []string{sorted + ":2,FS", unsorted + ":2,SF"} {
+		name = strings.Replace(name, ":", string(Separator), 1)
+		if err := ioutil.WriteFile(filepath.Join(string(d), "cur", name), nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	keys, err := d.CheckFlagOrder()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || keys[0] != unsorted {
+		t.Errorf("Dir.CheckFlagOrder() = %v, want [%v]", keys, unsorted)
+	}
+
+	if n, err := d.FixFlagOrder(); err != nil {
+		t.Fatal(err)
+	} else if n != 1 {
+		t.Errorf("Dir.FixFlagOrder() = %v, want 1", n)
+	}
+	if !exists(filepath.Join(string(d), "cur", unsorted+string(Separator)+"2,FS")) {
+		t.Error("message wasn't renamed with sorted flags")
+	}
+	if keys, err := d.CheckFlagOrder(); err != nil {
+		t.Fatal(err)
+	} else if len(keys) != 0 {
+		t.Errorf("Dir.CheckFlagOrder() after repair = %v, want none", keys)
+	}
+}
+
+func TestDir_List_unparsableName(t *testing.T) {
+	t.Parallel()
+
+	d := Dir(t.TempDir())
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+	key, err := d.Deliver(strings.NewReader("Subject: hello\r\n\r\n"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Unseen(); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Trash(key); err != nil {
+		t.Fatal(err)
+	}
+	for _, sub := range []string{"new", "cur"} {
+		if err := ioutil.WriteFile(filepath.Join(string(d), sub, string(Separator)), nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if entries, err := d.List(); err != nil {
+		t.Fatal(err)
+	} else if len(entries) != 1 || entries[0].Key != key {
+		t.Errorf("Dir.List() = %v, want a single entry for %v", entries, key)
+	}
+	if entries, err := d.AllEntries(); err != nil {
+		t.Fatal(err)
+	} else if len(entries) != 1 || entries[0].Key != key {
+		t.Errorf("Dir.AllEntries() = %v, want a single entry for %v", entries, key)
+	}
+	if purged, err := d.Purge(); err != nil {
+		t.Fatal(err)
+	} else if len(purged) != 1 || purged[0] != key {
+		t.Errorf("Dir.Purge() = %v, want [%v]", purged, key)
+	}
+}
+
+func TestDir_List(t *testing.T) {
+	t.Parallel()
+
+	d := Dir(t.TempDir())
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+	flags := [][]Flag{nil, {FlagSeen}, {FlagReplied, FlagSeen}, {FlagTrashed, FlagDraft}}
+	for i := range flags {
+		makeDelivery(t, d, fmt.Sprintf("here is message number %d", i))
+	}
+	keys, err := d.Unseen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, key := range keys {
+		if err := d.SetFlags(key, flags[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	entries, err := d.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != len(keys) {
+		t.Fatalf("Dir.List() returned %v entries, want %v", len(entries), len(keys))
+	}
+	for _, entry := range entries {
+		want, err := d.Flags(entry.Key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(flagsRunes(entry.Flags)) != string(flagsRunes(want)) {
+			t.Errorf("entry %v has flags %q, want %q", entry.Key, flagsRunes(entry.Flags), flagsRunes(want))
+		}
+		if entry.Size != int64(len("here is message number 0")) {
+			t.Errorf("entry %v has size %v", entry.Key, entry.Size)
+		}
+	}
+}
+
+func TestDir_MarkSeen(t *testing.T) {
+	t.Parallel()
+
+	d := Dir(t.TempDir())
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+	key, err := d.Deliver(strings.NewReader("a new message"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the message is moved from new to cur
+	if err := d.MarkSeen(key); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := d.UnseenCount(); err != nil {
+		t.Fatal(err)
+	} else if n != 0 {
+		t.Errorf("Dir.UnseenCount() = %v, want 0", n)
+	}
+	if err := d.SetFlags(key, []Flag{FlagFlagged, FlagSeen}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		mark func(key string) error
+		want string
+	}{
+		{d.MarkUnseen, "2,F"},
+		{d.MarkUnseen, "2,F"},
+		{d.MarkSeen, "2,FS"},
+		{d.MarkSeen, "2,FS"},
+	} {
+		if err := tc.mark(key); err != nil {
+			t.Fatal(err)
+		}
+		flags, err := d.Flags(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info := formatInfo(flags); info != tc.want {
+			t.Errorf("info = %q, want %q", info, tc.want)
+		}
+	}
+}
+
+func TestDir_UnseenEntries(t *testing.T) {
+	t.Parallel()
+
+	d := Dir(t.TempDir())
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+	sizes := make(map[string]int64)
+	for i := 0; i < 3; i++ {
+		msg := fmt.Sprintf("here is message number %d%s", i, strings.Repeat(".", i))
+		key, err := d.Deliver(strings.NewReader(msg), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sizes[key] = int64(len(msg))
+	}
+	// a message written to new by another program, with an info section
+	const flagged = "1600000000.M1.host"
+	if err := ioutil.WriteFile(filepath.Join(string(d), "new", flagged+string(Separator)+"2,F"), []byte("flagged"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	sizes[flagged] = int64(len("flagged"))
+
+	before := time.Now().Add(-time.Minute)
+	entries, err := d.UnseenEntries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != len(sizes) {
+		t.Fatalf("Dir.UnseenEntries() returned %v entries, want %v", len(entries), len(sizes))
+	}
+	for _, entry := range entries {
+		if entry.Size != sizes[entry.Key] {
+			t.Errorf("entry %v has size %v, want %v", entry.Key, entry.Size, sizes[entry.Key])
+		}
+		if entry.ModTime.Before(before) {
+			t.Errorf("entry %v has mtime %v", entry.Key, entry.ModTime)
+		}
+		wantFlags := ""
+		if entry.Key == flagged {
+			wantFlags = "F"
+		}
+		if string(flagsRunes(entry.Flags)) != wantFlags {
+			t.Errorf("entry %v has flags %q, want %q", entry.Key, flagsRunes(entry.Flags), wantFlags)
+		}
+		if _, err := d.Filename(entry.Key); err != nil {
+			t.Errorf("entry %v wasn't moved to cur: %v", entry.Key, err)
+		}
+	}
+	if n, err := d.UnseenCount(); err != nil {
+		t.Fatal(err)
+	} else if n != 0 {
+		t.Errorf("Dir.UnseenCount() = %v, want 0", n)
+	}
+}
+
+func TestDir_Recipients(t *testing.T) {
+	t.Parallel()
+
+	d := Dir(t.TempDir())
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+	const msg = "To: Alice <alice@example.org>, not an address, bob@example.org\r\n" +
+		"Cc: \"Carol\" <carol@example.org>, BOB@example.org\r\n" +
+		"Bcc: dave@example.org\r\n" +
+		"\r\n"
+	key, err := d.Deliver(strings.NewReader(msg), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Unseen(); err != nil {
+		t.Fatal(err)
+	}
+
+	addrs, err := d.Recipients(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"alice@example.org", "bob@example.org", "carol@example.org", "dave@example.org"}
+	if len(addrs) != len(want) {
+		t.Fatalf("Dir.Recipients() = %v, want %v", addrs, want)
+	}
+	for i, addr := range addrs {
+		if addr.Address != want[i] {
+			t.Errorf("Dir.Recipients()[%v] = %v, want %v", i, addr.Address, want[i])
+		}
+	}
+	if addrs[0].Name != "Alice" {
+		t.Errorf("display name = %q, want %q", addrs[0].Name, "Alice")
+	}
+}
+
+func TestDir_RFC822Size(t *testing.T) {
+	t.Parallel()
+
+	d := Dir(t.TempDir())
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+	const msg = "Subject: lf\n\nfirst line\nsecond line\r\nthird line\n"
+	key, err := d.Deliver(strings.NewReader(msg), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Unseen(); err != nil {
+		t.Fatal(err)
+	}
+
+	size, err := d.RFC822Size(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 4 bare LFs
+	if want := int64(len(msg) + 4); size != want {
+		t.Errorf("Dir.RFC822Size() = %v, want %v", size, want)
+	}
+
+	// W= takes precedence
+	if err := ioutil.WriteFile(filepath.Join(string(d), "cur", "1600000000.M1.host,S=10,W=12:2,"), []byte("0123456789"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if size, err := d.RFC822Size("1600000000.M1.host,S=10,W=12"); err != nil {
+		t.Fatal(err)
+	} else if size != 12 {
+		t.Errorf("Dir.RFC822Size() = %v, want 12", size)
+	}
+}
+
+func TestDir_Keys_TransientName(t *testing.T) {
+	d := Dir(t.TempDir())
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+	key, err := d.Deliver(strings.NewReader("Subject: hello\r\n\r\n"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Unseen(); err != nil {
+		t.Fatal(err)
+	}
+
+	// simulate a file showing up under an incomplete name while it's being
+	// renamed
+	testHookReaddir = func(dir string) {
+		if dir != filepath.Join(string(d), "cur") {
+			return
+		}
+		for _, name := range []string{"1600000000.M1.host", "1600000000.M2.host:"} {
+			if err := ioutil.WriteFile(filepath.Join(dir, name), nil, 0666); err != nil {
+				t.Error(err)
+			}
+		}
+	}
+	defer func() {
+		testHookReaddir = nil
+	}()
+
+	keys, err := d.Keys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || keys[0] != key {
+		t.Errorf("Dir.Keys() = %v, want [%v]", keys, key)
+	}
+	// the transient files are still there
+	if keys := streamKeys(t, d); len(keys) != 1 || keys[0] != key {
+		t.Errorf("Dir.KeysChan() = %v, want [%v]", keys, key)
+	}
+}
+
+// streamKeys returns the keys sent by d.KeysChan.
+func streamKeys(t *testing.T, d Dir) []string {
+	ch, errs := d.KeysChan(context.Background())
+	var keys []string
+	for key := range ch {
+		keys = append(keys, key)
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+	return keys
+}
+
+func TestDir_Flags_Copy(t *testing.T) {
+	t.Parallel()
+
+	d := Dir(t.TempDir())
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+	const key = "1600000000.M1.host"
+	path := filepath.Join(string(d), "cur", key+string(Separator)+"2,TSR")
+	if err := ioutil.WriteFile(path, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	want := []Flag{FlagReplied, FlagSeen, FlagTrashed}
+
+	flags, err := d.Flags(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(flagsRunes(flags)) != string(flagsRunes(want)) {
+		t.Fatalf("Dir.Flags() = %q, want %q", flagsRunes(flags), flagsRunes(want))
+	}
+	flags[0] = FlagDraft
+	sort.Slice(flags, func(i, j int) bool { return flags[i] > flags[j] })
+
+	for i := 0; i < 2; i++ {
+		again, err := d.Flags(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(flagsRunes(again)) != string(flagsRunes(want)) {
+			t.Errorf("Dir.Flags() = %q after modifying a previous result, want %q", flagsRunes(again), flagsRunes(want))
+		}
+	}
+}
+
+func TestDir_OpenFile(t *testing.T) {
+	t.Parallel()
+
+	d := Dir(t.TempDir())
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+	const msg = "Subject: serve me\r\n\r\nwhole message\r\n"
+	key, err := d.Deliver(strings.NewReader(msg), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Unseen(); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := d.OpenFile(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var buf bytes.Buffer
+	if _, err := io.Copy(&buf, f); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != msg {
+		t.Errorf("message = %q, want %q", buf.String(), msg)
+	}
+
+	const offset = int64(len("Subject: serve me\r\n\r\n"))
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != msg[offset:] {
+		t.Errorf("message after Seek = %q, want %q", b, msg[offset:])
+	}
+}
+
+func TestDir_TrailingSeparator(t *testing.T) {
+	t.Parallel()
+
+	d := Dir(t.TempDir())
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+	key, err := d.Deliver(strings.NewReader("Subject: slash\r\n\r\n"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Unseen(); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.SetFlags(key, []Flag{FlagSeen, FlagReplied}); err != nil {
+		t.Fatal(err)
+	}
+
+	type result struct {
+		keys     string
+		filename string
+		flags    string
+		key      string
+	}
+	run := func(d Dir) result {
+		keys, err := d.Keys()
+		if err != nil {
+			t.Fatal(err)
+		}
+		filename, err := d.Filename(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		flags, err := d.Flags(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		k, err := d.Key(filepath.Join(string(d), "msg"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return result{strings.Join(keys, ","), filename, string(flagsRunes(flags)), k}
+	}
+
+	want := run(d)
+	if got := run(d + Dir(filepath.Separator)); got != want {
+		t.Errorf("results with a trailing separator = %+v, want %+v", got, want)
+	}
+}
+
+func TestDir_Keys_MisplacedFolder(t *testing.T) {
+	d := Dir(t.TempDir())
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+	key, err := d.Deliver(strings.NewReader("Subject: hello\r\n\r\n"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Unseen(); err != nil {
+		t.Fatal(err)
+	}
+	misplaced := filepath.Join(string(d), "cur", ".Work")
+	if err := Dir(misplaced).Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	var warnings []error
+	Warning = func(err error) {
+		warnings = append(warnings, err)
+	}
+	defer func() {
+		Warning = nil
+	}()
+
+	keys, err := d.Keys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || keys[0] != key {
+		t.Errorf("Dir.Keys() = %v, want [%v]", keys, key)
+	}
+	entries, err := d.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Key != key {
+		t.Errorf("Dir.List() = %v, want a single entry for %v", entries, key)
+	}
+	if keys := streamKeys(t, d); len(keys) != 1 || keys[0] != key {
+		t.Errorf("Dir.KeysChan() = %v, want [%v]", keys, key)
+	}
+
+	if len(warnings) != 3 {
+		t.Fatalf("got warnings %v, want one for each of Keys, List and KeysChan", warnings)
+	}
+	for _, w := range warnings {
+		var folderErr *MisplacedFolderError
+		if !errors.As(w, &folderErr) || folderErr.Path != misplaced {
+			t.Errorf("warning = %v, want a *MisplacedFolderError for %v", w, misplaced)
+		}
+	}
+}
+
+func TestDir_Filename_ExactMatch(t *testing.T) {
+	t.Parallel()
+
+	d := Dir(t.TempDir())
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+	// keyword flags aren't guessed, so the directory is always scanned
+	files := []string{
+		"1600000000.abc.host:2,a",
+		"1600000000.abc.host2:2,a",
+		"1600000000.*.host:2,a",
+		"1600000000.[x].host:2,a",
+	}
+	for _, name := range files {
+		name = strings.Replace(name, ":", string(Separator), 1)
+		if err := ioutil.WriteFile(filepath.Join(string(d), "cur", name), nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, name := range files {
+		key := name[:strings.IndexByte(name, ':')]
+		want := filepath.Join(string(d), "cur", strings.Replace(name, ":", string(Separator), 1))
+		if got, err := d.Filename(key); err != nil {
+			t.Errorf("Dir.Filename(%q) = %v", key, err)
+		} else if got != want {
+			t.Errorf("Dir.Filename(%q) = %q, want %q", key, got, want)
+		}
+	}
+
+	for _, key := range []string{"1600000000.abc", "1600000000.*", "*"} {
+		var keyErr *KeyError
+		if _, err := d.Filename(key); !errors.As(err, &keyErr) || keyErr.N != 0 {
+			t.Errorf("Dir.Filename(%q) = %v, want a *KeyError with N = 0", key, err)
+		}
+	}
+}
+
+func TestDir_AddFlags_RemoveFlags(t *testing.T) {
+	t.Parallel()
+
+	d := Dir(t.TempDir())
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+	key, err := d.Deliver(strings.NewReader("Subject: flags\r\n\r\n"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Unseen(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, step := range []struct {
+		name string
+		op   func() error
+		want string
+	}{
+		{"add", func() error { return d.AddFlags(key, FlagTrashed, FlagSeen, FlagSeen) }, "2,ST"},
+		{"add present", func() error { return d.AddFlags(key, FlagSeen) }, "2,ST"},
+		{"add more", func() error { return d.AddFlags(key, FlagFlagged, FlagDraft) }, "2,DFST"},
+		{"remove", func() error { return d.RemoveFlags(key, FlagSeen, FlagDraft) }, "2,FT"},
+		{"remove absent", func() error { return d.RemoveFlags(key, FlagReplied) }, "2,FT"},
+		{"remove all", func() error { return d.RemoveFlags(key, FlagFlagged, FlagTrashed) }, "2,"},
+		{"set", func() error { return d.SetFlags(key, []Flag{FlagReplied, FlagPassed, FlagReplied}) }, "2,PR"},
+		{"set empty", func() error { return d.SetFlags(key, nil) }, "2,"},
+	} {
+		if err := step.op(); err != nil {
+			t.Fatalf("%v: %v", step.name, err)
+		}
+		filename, err := d.Filename(key)
+		if err != nil {
+			t.Fatalf("%v: %v", step.name, err)
+		}
+		if want := key + string(Separator) + step.want; filepath.Base(filename) != want {
+			t.Errorf("%v: filename = %q, want %q", step.name, filepath.Base(filename), want)
+		}
+	}
+}
+
+func TestDir_RenameInNew(t *testing.T) {
+	t.Parallel()
+
+	d := Dir(t.TempDir())
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+	// an imported message colliding with an existing one
+	const existing = "1600000000.M1.host"
+	const imported = "1600000000.M1.host-import"
+	for key, content := range map[string]string{existing: "existing", imported: "imported"} {
+		if err := ioutil.WriteFile(filepath.Join(string(d), "new", key), []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	key, err := d.RenameInNew(imported, existing)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key == existing || key == imported {
+		t.Fatalf("Dir.RenameInNew() = %q, want a fresh key", key)
+	}
+	if got := cat(t, filepath.Join(string(d), "new", key)); got != "imported" {
+		t.Errorf("renamed message = %q, want %q", got, "imported")
+	}
+	if got := cat(t, filepath.Join(string(d), "new", existing)); got != "existing" {
+		t.Errorf("existing message = %q, want %q", got, "existing")
+	}
+	if _, err := os.Stat(filepath.Join(string(d), "new", imported)); !os.IsNotExist(err) {
+		t.Errorf("old file still exists: %v", err)
+	}
+
+	// a free key is used as is
+	const desired = "1600000001.M2.host"
+	if got, err := d.RenameInNew(key, desired); err != nil {
+		t.Fatal(err)
+	} else if got != desired {
+		t.Errorf("Dir.RenameInNew() = %q, want %q", got, desired)
+	}
+	if n, err := d.UnseenCount(); err != nil {
+		t.Fatal(err)
+	} else if n != 2 {
+		t.Errorf("Dir.UnseenCount() = %v, want 2", n)
+	}
+
+	var keyErr *KeyError
+	if _, err := d.RenameInNew("missing", desired); !errors.As(err, &keyErr) || keyErr.N != 0 {
+		t.Errorf("Dir.RenameInNew() = %v, want a *KeyError with N = 0", err)
+	}
+}
+
+func TestDir_Move_Fallback(t *testing.T) {
+	src := Dir(t.TempDir())
+	dst := Dir(t.TempDir())
+	for _, d := range []Dir{src, dst} {
+		if err := d.Init(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	key, err := src.Deliver(strings.NewReader("moved across devices"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := src.Unseen(); err != nil {
+		t.Fatal(err)
+	}
+	if err := src.SetFlags(key, []Flag{FlagSeen}); err != nil {
+		t.Fatal(err)
+	}
+	// the name is already used in the target
+	if err := ioutil.WriteFile(filepath.Join(string(dst), "cur", key+string(Separator)+"2,S"), []byte("other"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	testHookLink = func(oldpath, newpath string) error {
+		if strings.HasPrefix(oldpath, string(src)) {
+			return &os.LinkError{Op: "link", Old: oldpath, New: newpath, Err: errCrossDevice}
+		}
+		return os.Link(oldpath, newpath)
+	}
+	defer func() {
+		testHookLink = nil
+	}()
+
+	moved, err := src.Move(dst, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if moved == key {
+		t.Errorf("Dir.Move() = %q, want a new key", moved)
+	}
+	filename, err := dst.Filename(moved)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := cat(t, filename); got != "moved across devices" {
+		t.Errorf("moved message = %q, want %q", got, "moved across devices")
+	}
+	if flags, err := dst.Flags(moved); err != nil {
+		t.Fatal(err)
+	} else if len(flags) != 1 || flags[0] != FlagSeen {
+		t.Errorf("Dir.Flags() = %v, want [%v]", flags, FlagSeen)
+	}
+	var keyErr *KeyError
+	if _, err := src.Filename(key); !errors.As(err, &keyErr) || keyErr.N != 0 {
+		t.Errorf("source message still exists: %v", err)
+	}
+	if entries, err := dst.ListTmp(); err != nil {
+		t.Fatal(err)
+	} else if len(entries) != 0 {
+		t.Errorf("Dir.ListTmp() = %v, want no leftover", entries)
+	}
+}
+
+func TestDir_Move_collision(t *testing.T) {
+	// don't run this test in // as it sets a package variable
+	src := Dir(t.TempDir())
+	dst := Dir(t.TempDir())
+	for _, d := range []Dir{src, dst} {
+		if err := d.Init(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	key, err := src.Deliver(strings.NewReader("moved"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := src.Unseen(); err != nil {
+		t.Fatal(err)
+	}
+	existing := filepath.Join(string(dst), "cur", key+string(Separator)+"2,")
+	if err := ioutil.WriteFile(existing, []byte("existing"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	scans := 0
+	testHookReaddir = func(dir string) {
+		if strings.HasPrefix(dir, string(dst)) {
+			scans++
+		}
+	}
+	defer func() {
+		testHookReaddir = nil
+	}()
+
+	moved, err := src.Move(dst, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if scans != 0 {
+		t.Errorf("Dir.Move() listed the target %v times, want 0", scans)
+	}
+	if moved == key {
+		t.Errorf("Dir.Move() = %q, want a new key", moved)
+	}
+	if got := cat(t, existing); got != "existing" {
+		t.Errorf("existing message = %q, want it untouched", got)
+	}
+	if got := cat(t, filepath.Join(string(dst), "cur", moved+string(Separator)+"2,")); got != "moved" {
+		t.Errorf("moved message = %q, want %q", got, "moved")
+	}
+}
+
+func TestDir_Move_New(t *testing.T) {
+	t.Parallel()
+
+	src := Dir(t.TempDir())
+	dst := Dir(t.TempDir())
+	for _, d := range []Dir{src, dst} {
+		if err := d.Init(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// messages still in new, e.g. not yet moved to cur by a concurrent
+	// Unseen, are moved and removed as well
+	key, err := src.Deliver(strings.NewReader("in new"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	moved, err := src.Move(dst, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if moved != key {
+		t.Errorf("Dir.Move() = %q, want %q", moved, key)
+	}
+	if _, err := dst.Filename(moved); err != nil {
+		t.Error(err)
+	}
+
+	key, err = src.Deliver(strings.NewReader("in new"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := src.Remove(key); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := src.UnseenCount(); err != nil {
+		t.Fatal(err)
+	} else if n != 0 {
+		t.Errorf("Dir.UnseenCount() = %v, want 0", n)
+	}
+	if keys, err := src.Keys(); err != nil {
+		t.Fatal(err)
+	} else if len(keys) != 0 {
+		t.Errorf("Dir.Keys() = %v, want none", keys)
+	}
+}
+
+func TestDir_IsRecent(t *testing.T) {
+	t.Parallel()
+
+	d := Dir(t.TempDir())
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+	recent, err := d.Deliver(strings.NewReader("Subject: recent\r\n\r\n"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seen, err := d.Deliver(strings.NewReader("Subject: seen\r\n\r\n"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.MarkSeen(seen); err != nil {
+		t.Fatal(err)
+	}
+
+	for key, want := range map[string]bool{recent: true, seen: false} {
+		if got, err := d.IsRecent(key); err != nil {
+			t.Fatal(err)
+		} else if got != want {
+			t.Errorf("Dir.IsRecent(%q) = %v, want %v", key, got, want)
+		}
+	}
+}
+
+func TestDir_KeysLargerThan(t *testing.T) {
+	t.Parallel()
+
+	d := Dir(t.TempDir())
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+	for _, n := range []int{10, 300, 100, 200, 50} {
+		makeDelivery(t, d, strings.Repeat("x", n))
+	}
+	if _, err := d.Unseen(); err != nil {
+		t.Fatal(err)
+	}
+	// the S= field is trusted over the actual size
+	const sized = "1600000000.M1.host,S=1000"
+	if err := ioutil.WriteFile(filepath.Join(string(d), "cur", sized+string(Separator)+"2,S"), []byte("small"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := d.KeysLargerThan(100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sizes []int64
+	for _, e := range entries {
+		sizes = append(sizes, e.Size)
+	}
+	if want := []int64{1000, 300, 200}; fmt.Sprint(sizes) != fmt.Sprint(want) {
+		t.Errorf("Dir.KeysLargerThan() sizes = %v, want %v", sizes, want)
+	}
+	if len(entries) > 0 && (entries[0].Key != sized || len(entries[0].Flags) != 1 || entries[0].ModTime.IsZero()) {
+		t.Errorf("Dir.KeysLargerThan()[0] = %+v, want the entry of %v", entries[0], sized)
+	}
+}
+
+func TestDir_DecodedHeader(t *testing.T) {
+	t.Parallel()
+
+	d := Dir(t.TempDir())
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+	const msg = "Subject: =?UTF-8?B?SGVsbG8g8J+Riw==?=\r\n" +
+		"Keywords: =?ISO-8859-1?Q?caf=E9?= and =?UTF-8?Q?cr=C3=A8me?=\r\n" +
+		"From: =?ISO-8859-1?Q?Andr=E9?= <andre@example.org>\r\n" +
+		"To: plain <bob@example.org>\r\n" +
+		"\r\n"
+	key, err := d.Deliver(strings.NewReader(msg), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Unseen(); err != nil {
+		t.Fatal(err)
+	}
+
+	for field, want := range map[string]string{
+		"Subject":  "Hello 👋",
+		"Keywords": "café and crème",
+		"From":     "André <andre@example.org>",
+		"To":       "plain <bob@example.org>",
+		"Cc":       "",
+	} {
+		if got, err := d.DecodedHeader(key, field); err != nil {
+			t.Errorf("Dir.DecodedHeader(%q) = %v", field, err)
+		} else if got != want {
+			t.Errorf("Dir.DecodedHeader(%q) = %q, want %q", field, got, want)
+		}
+	}
+}
+
+func TestDir_AllEntries(t *testing.T) {
+	t.Parallel()
+
+	d := Dir(t.TempDir())
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+	seen, err := d.Deliver(strings.NewReader("seen message"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.MarkSeen(seen); err != nil {
+		t.Fatal(err)
+	}
+	unseen, err := d.Deliver(strings.NewReader("new"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := d.AllEntries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("Dir.AllEntries() = %v, want 2 entries", entries)
+	}
+	byKey := make(map[string]Entry)
+	for _, e := range entries {
+		byKey[e.Key] = e
+		if e.ModTime.IsZero() {
+			t.Errorf("entry %v has no modification time", e.Key)
+		}
+	}
+	if e := byKey[unseen]; e.Sub != "new" || len(e.Flags) != 0 || e.Size != int64(len("new")) {
+		t.Errorf("entry for the new message = %+v", e)
+	}
+	if e := byKey[seen]; e.Sub != "cur" || len(e.Flags) != 1 || e.Flags[0] != FlagSeen || e.Size != int64(len("seen message")) {
+		t.Errorf("entry for the seen message = %+v", e)
+	}
+}
+
+func TestDir_SetFlags_Keywords(t *testing.T) {
+	t.Parallel()
+
+	d := Dir(t.TempDir())
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+	key, err := d.Deliver(strings.NewReader("Subject: keywords\r\n\r\n"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Unseen(); err != nil {
+		t.Fatal(err)
+	}
+
+	info := func() string {
+		filename, err := d.Filename(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		name := filepath.Base(filename)
+		return name[len(key)+1:]
+	}
+
+	if err := d.SetFlags(key, []Flag{'c', FlagSeen, 'a'}); err != nil {
+		t.Fatal(err)
+	}
+	if got := info(); got != "2,Sac" {
+		t.Errorf("info = %q, want %q", got, "2,Sac")
+	}
+	// keywords are kept by the other flag operations
+	if err := d.AddFlags(key, FlagFlagged, 'b'); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.MarkUnseen(key); err != nil {
+		t.Fatal(err)
+	}
+	if got := info(); got != "2,Fabc" {
+		t.Errorf("info = %q, want %q", got, "2,Fabc")
+	}
+}
+
+func TestDir_Flags_ErrorFilename(t *testing.T) {
+	t.Parallel()
+
+	d := Dir(t.TempDir())
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+	const key = "1600000000.M1.host"
+	path := filepath.Join(string(d), "cur", key+string(Separator)+"1,experimental")
+	if err := ioutil.WriteFile(path, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := d.Flags(key)
+	if err == nil {
+		t.Fatal("Dir.Flags() succeeded")
+	}
+	if !strings.Contains(err.Error(), path) {
+		t.Errorf("error %q doesn't mention %v", err, path)
+	}
+	var flagErr *FlagError
+	if !errors.As(err, &flagErr) {
+		t.Fatalf("error %v isn't a *FlagError", err)
+	}
+	if !flagErr.Experimental || flagErr.Info != "1,experimental" {
+		t.Errorf("FlagError = %+v", flagErr)
+	}
+}
+
+func TestDir_Keys_partial(t *testing.T) {
+	d := Dir(t.TempDir())
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+	var want []string
+	for i := 0; i < 3; i++ {
+		key, err := d.Deliver(strings.NewReader("Subject: hello\r\n\r\n"), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want = append(want, key)
+	}
+	if _, err := d.Unseen(); err != nil {
+		t.Fatal(err)
+	}
+
+	// simulate a readdir failing after the first entry, as may happen on NFS
+	errStale := errors.New("stale file handle")
+	testHookReaddirResult = func(dir string, names []string, err error) ([]string, error) {
+		if dir != filepath.Join(string(d), "cur") || err != nil {
+			return names, err
+		}
+		return names[:1], errStale
+	}
+	defer func() {
+		testHookReaddirResult = nil
+	}()
+
+	keys, err := d.Keys()
+	if !errors.Is(err, errStale) {
+		t.Fatalf("Dir.Keys() error = %v, want %v", err, errStale)
+	}
+	if len(keys) != 1 {
+		t.Fatalf("Dir.Keys() = %v, want a single key", keys)
+	}
+	found := false
+	for _, key := range want {
+		found = found || key == keys[0]
+	}
+	if !found {
+		t.Errorf("Dir.Keys() = %v, want one of %v", keys, want)
+	}
+}
+
+// parseFlagsFieldsFunc is the reference implementation of parseFlags, which
+// splits the filename with strings.FieldsFunc.
+func parseFlagsFieldsFunc(filename string) ([]Flag, error) {
+	split := strings.FieldsFunc(filepath.Base(filename), func(r rune) bool {
+		return r == Separator
+	})
+	switch {
+	case len(split) <= 1:
+		return nil, &MailfileError{filename}
+	case len(split[1]) < 2,
+		split[1][1] != ',':
+		return nil, &FlagError{split[1], false}
+	case split[1][0] == '1':
+		return nil, &FlagError{split[1], true}
+	case split[1][0] != '2':
+		return nil, &FlagError{split[1], false}
+	}
+	fl := flagList(split[1][2:])
+	sort.Sort(fl)
+	return []Flag(fl), nil
+}
+
+var parseFlagsTests = []string{
+	"1600000000.M1.host:2,",
+	"1600000000.M1.host:2,S",
+	"1600000000.M1.host:2,TSRFD",
+	"1600000000.M1.host:2,Sbac",
+	"1600000000.M1.host:2,SS",
+	"1600000000.M1.host::2,RS",
+	"1600000000.M1.host:2,S:extra",
+	"cur/1600000000.M1.host:2,PS",
+	":1600000000.M1.host:2,S",
+	"1600000000.M1.host",
+	"1600000000.M1.host:",
+	"1600000000.M1.host:2",
+	"1600000000.M1.host:1,experimental",
+	"1600000000.M1.host:3,S",
+	"1600000000.M1.host:2,é",
+}
+
+func TestParseFlags(t *testing.T) {
+	t.Parallel()
+
+	for _, name := range parseFlagsTests {
+		want, wantErr := parseFlagsFieldsFunc(name)
+		got, err := parseFlags(name)
+		if !reflect.DeepEqual(err, wantErr) {
+			t.Errorf("parseFlags(%q) error = %v, want %v", name, err, wantErr)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("parseFlags(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
+
+func BenchmarkParseFlags(b *testing.B) {
+	const name = "1600000000.M123P456Q7.host,S=1234:2,TSRFa"
+	b.Run("FieldsFunc", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			parseFlagsFieldsFunc(name)
+		}
+	})
+	b.Run("Scan", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			parseFlags(name)
+		}
+	})
+}
+
+func TestDir_Filename_basename(t *testing.T) {
+	t.Parallel()
+
+	d := Dir(t.TempDir())
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+	key, err := d.Deliver(strings.NewReader("Subject: hello\r\n\r\n"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Unseen(); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.SetFlags(key, []Flag{FlagSeen, FlagFlagged}); err != nil {
+		t.Fatal(err)
+	}
+	filename, err := d.Filename(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	basename := filepath.Base(filename)
+
+	flags, err := d.Flags(basename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(flagsRunes(flags)) != "FS" {
+		t.Errorf("Dir.Flags(%q) = %q, want \"FS\"", basename, flagsRunes(flags))
+	}
+	msg, err := d.Message(basename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := msg.Header.Get("Subject"); got != "hello" {
+		t.Errorf("Subject = %q, want \"hello\"", got)
+	}
+
+	if err := d.SetFlags(basename, []Flag{FlagSeen}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(string(d), "cur", key+string(Separator)+"2,S")); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDir_Purge(t *testing.T) {
+	t.Parallel()
+
+	d := Dir(t.TempDir())
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+	var keys []string
+	for i := 0; i < 3; i++ {
+		key, err := d.Deliver(strings.NewReader(fmt.Sprintf("Subject: %d\r\n\r\n", i)), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, key)
+	}
+	if _, err := d.Unseen(); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.SetFlags(keys[1], []Flag{FlagSeen}); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Trash(keys[1]); err != nil {
+		t.Fatal(err)
+	}
+
+	purged, err := d.Purge()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(purged) != 1 || purged[0] != keys[1] {
+		t.Errorf("Dir.Purge() = %v, want [%v]", purged, keys[1])
+	}
+	left, err := d.Keys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(left)
+	want := []string{keys[0], keys[2]}
+	sort.Strings(want)
+	if !reflect.DeepEqual(left, want) {
+		t.Errorf("Dir.Keys() after Purge = %v, want %v", left, want)
+	}
+}
+
+func TestDir_Walk(t *testing.T) {
+	t.Parallel()
+
+	d := Dir(t.TempDir())
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+	want := make(map[string]string)
+	for i := 0; i < 3; i++ {
+		msg := fmt.Sprintf("Subject: %d\r\n\r\n%s", i, strings.Repeat("x", i*1000))
+		key, err := d.Deliver(strings.NewReader(msg), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want[key] = msg
+	}
+	keys, err := d.Unseen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.SetFlags(keys[0], []Flag{FlagSeen}); err != nil {
+		t.Fatal(err)
+	}
+
+	got := make(map[string]string)
+	err = d.Walk(func(key string, flags []Flag, r io.Reader) error {
+		b, err := ioutil.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		got[key] = string(b)
+		if wantFlags := key == keys[0]; wantFlags != (len(flags) == 1 && flags[0] == FlagSeen) {
+			t.Errorf("message %q has flags %q", key, flagsRunes(flags))
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Dir.Walk() visited %v, want %v", got, want)
+	}
+
+	errStop := errors.New("stop")
+	visited := 0
+	err = d.Walk(func(key string, flags []Flag, r io.Reader) error {
+		visited++
+		return errStop
+	})
+	if err != errStop || visited != 1 {
+		t.Errorf("Dir.Walk() = %v after %d messages, want %v after 1", err, visited, errStop)
+	}
+}
+
+func TestKeyHostname(t *testing.T) {
+	defer func(sep rune) {
+		Separator = sep
+	}(Separator)
+	Separator = '!'
+	testHookHostname = func() (string, error) {
+		return `mail/box!1\x`, nil
+	}
+	defer func() {
+		testHookHostname = nil
+	}()
+
+	host, err := keyHostname()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `mail_057box_0411_134x`; host != want {
+		t.Errorf("keyHostname() = %q, want %q", host, want)
+	}
+
+	d := Dir(t.TempDir())
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+	key, err := d.Deliver(strings.NewReader("Subject: hello\r\n\r\n"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(key, "."+host+".") {
+		t.Errorf("key %q doesn't contain the hostname %q", key, host)
+	}
+	if _, err := d.Unseen(); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.SetFlags(key, []Flag{FlagSeen}); err != nil {
+		t.Fatal(err)
+	}
+	if flags, err := d.Flags(key); err != nil {
+		t.Fatal(err)
+	} else if string(flagsRunes(flags)) != "S" {
+		t.Errorf("Dir.Flags() = %q, want \"S\"", flagsRunes(flags))
+	}
+}
+
+func TestDir_Walk_skipped(t *testing.T) {
+	t.Parallel()
+
+	d := Dir(t.TempDir())
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+	const key = "1600000000.M1.host"
+	cur := filepath.Join(string(d), "cur")
+	for _, name := range []string{key + string(Separator) + "2,S", "1600000000.M2.host", "1600000000.M3.host" + string(Separator)} {
+		if err := ioutil.WriteFile(filepath.Join(cur, name), nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := Dir(filepath.Join(cur, ".Work")).Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	var walked, iterated []string
+	if err := d.Walk(func(key string, flags []Flag, r io.Reader) error {
+		walked = append(walked, key)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.ForEachMessage(func(key string, r io.Reader) error {
+		iterated = append(iterated, key)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(walked) != 1 || walked[0] != key {
+		t.Errorf("Dir.Walk() visited %v, want [%v]", walked, key)
+	}
+	if len(iterated) != 1 || iterated[0] != key {
+		t.Errorf("Dir.ForEachMessage() visited %v, want [%v]", iterated, key)
+	}
+}
+
+func TestSeparator(t *testing.T) {
+	defer func(sep rune) {
+		Separator = sep
+	}(Separator)
+	Separator = ';'
+
+	d := Dir(t.TempDir())
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+	const msg = "Subject: hello\r\n\r\n"
+	key, err := d.Deliver(strings.NewReader(msg), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.ContainsRune(key, ':') || strings.ContainsRune(key, ';') {
+		t.Errorf("key %q contains a separator", key)
+	}
+	if _, err := d.Unseen(); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.SetFlags(key, []Flag{FlagSeen, FlagReplied}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(string(d), "cur", key+";2,RS")); err != nil {
+		t.Fatal(err)
+	}
+
+	keys, err := d.Keys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || keys[0] != key {
+		t.Errorf("Dir.Keys() = %v, want [%v]", keys, key)
+	}
+	flags, err := d.Flags(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(flagsRunes(flags)) != "RS" {
+		t.Errorf("Dir.Flags() = %q, want \"RS\"", flagsRunes(flags))
+	}
+	if err := d.AddFlags(key, FlagFlagged); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := d.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Key != key || string(flagsRunes(entries[0].Flags)) != "FRS" {
+		t.Errorf("Dir.List() = %+v, want a single entry for %q with flags FRS", entries, key)
+	}
+	msgFile, err := d.Open(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer msgFile.Close()
+	if b, err := ioutil.ReadAll(msgFile); err != nil {
+		t.Fatal(err)
+	} else if string(b) != msg {
+		t.Errorf("message = %q, want %q", b, msg)
+	}
+}
+
+func TestDir_basenameKeys(t *testing.T) {
+	t.Parallel()
+
+	const msg = "Subject: hello\n\nbody\n"
+	setup := func(t *testing.T) (Dir, string) {
+		d := Dir(t.TempDir())
+		if err := d.Init(); err != nil {
+			t.Fatal(err)
+		}
+		key, err := d.Deliver(strings.NewReader(msg), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d, key
+	}
+	seen := func(t *testing.T, d Dir, key string) string {
+		if _, err := d.Unseen(); err != nil {
+			t.Fatal(err)
+		}
+		if err := d.SetFlags(key, []Flag{FlagSeen}); err != nil {
+			t.Fatal(err)
+		}
+		return key + string(Separator) + "2,S"
+	}
+
+	t.Run("Move", func(t *testing.T) {
+		d, key := setup(t)
+		basename := seen(t, d, key)
+		target := Dir(t.TempDir())
+		if err := target.Init(); err != nil {
+			t.Fatal(err)
+		}
+		// an info section longer than the one of the file
+		moved, err := d.Move(target, key+string(Separator)+"2,FRS")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if moved != key {
+			t.Errorf("Dir.Move() = %q, want %q", moved, key)
+		}
+		if _, err := os.Stat(filepath.Join(string(target), "cur", basename)); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("Remove", func(t *testing.T) {
+		d, key := setup(t)
+		seen(t, d, key)
+		basename, err := d.Filename(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		basename = filepath.Base(basename)
+		if _, err := d.SetFlagsModSeq(basename, []Flag{FlagSeen}); err != nil {
+			t.Fatal(err)
+		}
+		if modseq, err := d.ModSeq(key); err != nil || modseq == 0 {
+			t.Fatalf("Dir.ModSeq() = %v, %v, want a modification sequence", modseq, err)
+		}
+		if err := d.Remove(basename); err != nil {
+			t.Fatal(err)
+		}
+		if modseq, err := d.ModSeq(key); err != nil || modseq != 0 {
+			t.Errorf("Dir.ModSeq() after Remove = %v, %v, want 0", modseq, err)
+		}
+	})
+
+	t.Run("IsRecent", func(t *testing.T) {
+		d, key := setup(t)
+		recent, err := d.IsRecent(key + string(Separator) + "2,")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !recent {
+			t.Error("Dir.IsRecent() = false, want true")
+		}
+	})
+
+	t.Run("RFC822Size", func(t *testing.T) {
+		d, key := setup(t)
+		basename := seen(t, d, key)
+		size, err := d.RFC822Size(basename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := int64(len(strings.Replace(msg, "\n", "\r\n", -1))); size != want {
+			t.Errorf("Dir.RFC822Size() = %v, want %v", size, want)
+		}
+	})
+
+	t.Run("MarkSeen", func(t *testing.T) {
+		d, key := setup(t)
+		if err := d.MarkSeen(key + string(Separator) + "2,"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := os.Stat(filepath.Join(string(d), "cur", key+string(Separator)+"2,S")); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+func TestDir_MoveBatch_collision(t *testing.T) {
+	// don't run this test in // as it sets a package variable
+	src := Dir(t.TempDir())
+	dst := Dir(t.TempDir())
+	for _, d := range []Dir{src, dst} {
+		if err := d.Init(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	key, err := src.Deliver(strings.NewReader("moved"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := src.Deliver(strings.NewReader("copied"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := src.Unseen(); err != nil {
+		t.Fatal(err)
+	}
+	// the target already holds a message with the same key
+	existing := filepath.Join(string(dst), "cur", key+string(Separator)+"2,")
+	if err := ioutil.WriteFile(existing, []byte("existing"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	// messages are copied across filesystems
+	testHookLink = func(oldpath, newpath string) error {
+		if strings.HasPrefix(oldpath, string(src)) && strings.Contains(oldpath, other) {
+			return &os.LinkError{Op: "link", Old: oldpath, New: newpath, Err: errCrossDevice}
+		}
+		return os.Link(oldpath, newpath)
+	}
+	defer func() {
+		testHookLink = nil
+	}()
+	scans := make(map[string]int)
+	testHookReaddir = func(dir string) {
+		if strings.HasPrefix(dir, string(dst)) {
+			scans[filepath.Base(dir)]++
+		}
+	}
+	defer func() {
+		testHookReaddir = nil
+	}()
+
+	moved, errs := src.MoveBatch([]string{key, other}, dst)
+	if len(errs) != 0 {
+		t.Fatalf("Dir.MoveBatch() errors = %v", errs)
+	}
+	if scans["new"] != 1 || scans["cur"] != 1 || len(scans) != 2 {
+		t.Errorf("Dir.MoveBatch() listed the target directories %v times, want new and cur once", scans)
+	}
+	if moved[key] == "" || moved[key] == key {
+		t.Errorf("colliding key %q mapped to %q, want a new key", key, moved[key])
+	}
+	if moved[other] != other {
+		t.Errorf("key %q mapped to %q", other, moved[other])
+	}
+	if got := cat(t, existing); got != "existing" {
+		t.Errorf("existing message = %q, want it untouched", got)
+	}
+	for k, want := range map[string]string{moved[key]: "moved", moved[other]: "copied"} {
+		filename, err := dst.Filename(k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := cat(t, filename); got != want {
+			t.Errorf("moved message %q = %q, want %q", k, got, want)
+		}
+	}
+	if keys, err := src.Keys(); err != nil || len(keys) != 0 {
+		t.Errorf("source keys after Dir.MoveBatch() = %v, %v, want none", keys, err)
+	}
+}
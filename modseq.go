@@ -0,0 +1,119 @@
+package maildir
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// modseqFile is the name of the file, in the Maildir root, which stores
+// modification sequences.
+//
+// The first line holds the highest modification sequence of the Maildir. It is
+// followed by one "<modseq> <key>" line per message whose flags have been
+// changed through SetFlagsModSeq.
+const modseqFile = "maildir-modseq"
+
+// modseqs holds the content of modseqFile.
+type modseqs struct {
+	highest uint64
+	keys    map[string]uint64
+}
+
+func (d Dir) readModSeqs() (*modseqs, error) {
+	ms := &modseqs{keys: make(map[string]uint64)}
+	b, err := ioutil.ReadFile(filepath.Join(string(d), modseqFile))
+	if os.IsNotExist(err) {
+		return ms, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	s := bufio.NewScanner(bytes.NewReader(b))
+	if s.Scan() {
+		ms.highest, err = strconv.ParseUint(s.Text(), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("maildir: invalid %v: %v", modseqFile, err)
+		}
+	}
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("maildir: invalid %v line: %q", modseqFile, s.Text())
+		}
+		modseq, err := strconv.ParseUint(fields[0], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("maildir: invalid %v: %v", modseqFile, err)
+		}
+		ms.keys[fields[1]] = modseq
+	}
+	return ms, s.Err()
+}
+
+// writeModSeqs replaces modseqFile with ms, the keys being sorted so that the
+// content is deterministic.
+func (d Dir) writeModSeqs(ms *modseqs) error {
+	keys := make([]string, 0, len(ms.keys))
+	for key := range ms.keys {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%d\n", ms.highest)
+	for _, key := range keys {
+		fmt.Fprintf(&buf, "%d %s\n", ms.keys[key], key)
+	}
+	return writeFileAtomic(d, modseqFile, buf.Bytes())
+}
+
+// SetFlagsModSeq works like SetFlags, but also assigns the message a new
+// modification sequence, as needed by IMAP CONDSTORE. Modification sequences
+// are strictly increasing per Maildir, and are persisted in the Maildir root
+// under the lock of its sidecar files.
+func (d Dir) SetFlagsModSeq(key string, flags []Flag) (uint64, error) {
+	key = trimInfo(key)
+	unlock, err := d.lockSidecars()
+	if err != nil {
+		return 0, err
+	}
+	defer unlock()
+	ms, err := d.readModSeqs()
+	if err != nil {
+		return 0, err
+	}
+	if err := d.SetFlags(key, flags); err != nil {
+		return 0, err
+	}
+	ms.highest++
+	ms.keys[key] = ms.highest
+	if err := d.writeModSeqs(ms); err != nil {
+		return 0, err
+	}
+	return ms.highest, nil
+}
+
+// ModSeq returns the modification sequence of a message, or 0 if its flags
+// have never been changed through SetFlagsModSeq.
+func (d Dir) ModSeq(key string) (uint64, error) {
+	key = trimInfo(key)
+	ms, err := d.readModSeqs()
+	if err != nil {
+		return 0, err
+	}
+	return ms.keys[key], nil
+}
+
+// HighestModSeq returns the highest modification sequence of the Maildir.
+func (d Dir) HighestModSeq() (uint64, error) {
+	ms, err := d.readModSeqs()
+	if err != nil {
+		return 0, err
+	}
+	return ms.highest, nil
+}
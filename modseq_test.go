@@ -0,0 +1,110 @@
+package maildir
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestDir_SetFlagsModSeq(t *testing.T) {
+	t.Parallel()
+
+	d := Dir(t.TempDir())
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+	makeDelivery(t, d, "first message")
+	makeDelivery(t, d, "second message")
+	keys, err := d.Unseen()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first, err := d.SetFlagsModSeq(keys[0], []Flag{FlagSeen})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// reopen the Maildir: the counter must have been persisted
+	reopened := Dir(string(d))
+	second, err := reopened.SetFlagsModSeq(keys[1], []Flag{FlagFlagged})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second <= first {
+		t.Errorf("modseq %v after %v, want strictly increasing", second, first)
+	}
+
+	if highest, err := reopened.HighestModSeq(); err != nil {
+		t.Fatal(err)
+	} else if highest != second {
+		t.Errorf("Dir.HighestModSeq() = %v, want %v", highest, second)
+	}
+	if modseq, err := reopened.ModSeq(keys[0]); err != nil {
+		t.Fatal(err)
+	} else if modseq != first {
+		t.Errorf("Dir.ModSeq() = %v, want %v", modseq, first)
+	}
+
+	flags, err := reopened.Flags(keys[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(flags) != 1 || flags[0] != FlagFlagged {
+		t.Errorf("Dir.Flags() = %v, want {FlagFlagged}", flags)
+	}
+}
+
+func TestDir_SetFlagsModSeq_concurrent(t *testing.T) {
+	t.Parallel()
+
+	d := Dir(t.TempDir())
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 20; i++ {
+		makeDelivery(t, d, fmt.Sprintf("message %d", i))
+	}
+	keys, err := d.Unseen()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	modseqs := make([]uint64, len(keys))
+	errs := make([]error, len(keys))
+	var wg sync.WaitGroup
+	for i, key := range keys {
+		wg.Add(1)
+		go func(i int, key string) {
+			defer wg.Done()
+			modseqs[i], errs[i] = d.SetFlagsModSeq(key, []Flag{FlagSeen})
+		}(i, key)
+	}
+	wg.Wait()
+	seen := make(map[uint64]bool)
+	for i, modseq := range modseqs {
+		if errs[i] != nil {
+			t.Fatal(errs[i])
+		} else if seen[modseq] {
+			t.Errorf("modseq %v returned twice", modseq)
+		}
+		seen[modseq] = true
+	}
+	if highest, err := d.HighestModSeq(); err != nil {
+		t.Fatal(err)
+	} else if highest != uint64(len(keys)) {
+		t.Errorf("Dir.HighestModSeq() = %v, want %v", highest, len(keys))
+	}
+
+	// the keys are sorted in the file
+	lines := strings.Split(strings.TrimSpace(cat(t, filepath.Join(string(d), modseqFile))), "\n")[1:]
+	sorted := sort.SliceIsSorted(lines, func(i, j int) bool {
+		return strings.Fields(lines[i])[1] < strings.Fields(lines[j])[1]
+	})
+	if len(lines) != len(keys) || !sorted {
+		t.Errorf("%v lines = %q, want one per key sorted by key", modseqFile, lines)
+	}
+}
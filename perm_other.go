@@ -0,0 +1,13 @@
+//go:build !aix && !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd && !solaris
+// +build !aix,!darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd,!solaris
+
+package maildir
+
+import (
+	"os"
+)
+
+// matchGroup is a no-op on platforms without Unix file ownership.
+func matchGroup(f *os.File, fi os.FileInfo) error {
+	return nil
+}
@@ -0,0 +1,18 @@
+//go:build aix || darwin || dragonfly || freebsd || linux || netbsd || openbsd || solaris
+// +build aix darwin dragonfly freebsd linux netbsd openbsd solaris
+
+package maildir
+
+import (
+	"os"
+	"syscall"
+)
+
+// matchGroup sets the group of f to the group owning fi.
+func matchGroup(f *os.File, fi os.FileInfo) error {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return nil
+	}
+	return f.Chown(-1, int(st.Gid))
+}
@@ -0,0 +1,254 @@
+package maildir
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// maildirsizeFile is the name of the Maildir++ quota file, in the Maildir
+// root.
+//
+// The first line holds the quota definition, e.g. "1000000S,1000C". It is
+// followed by "<bytes> <count>" lines, one per delivery or removal, whose sums
+// are the size and number of messages of the whole Maildir, folders included.
+const maildirsizeFile = "maildirsize"
+
+// maildirsizeLockFile is the name of the lock file, in the Maildir root,
+// serializing the updates of maildirsizeFile by this package.
+const maildirsizeLockFile = "maildirsize-lock"
+
+// ErrQuotaExceeded is returned when delivering a message with
+// DeliveryOptions.EnforceQuota would exceed the Maildir++ quota.
+var ErrQuotaExceeded = errors.New("maildir: quota exceeded")
+
+// A Quota describes the Maildir++ quota of a Maildir, as stored in its
+// maildirsize file, along with the usage recorded there. A zero limit means
+// no limit.
+type Quota struct {
+	MaxSize  int64 // the maximum total size of the messages in bytes
+	MaxCount int64 // the maximum number of messages
+	Size     int64 // the total size of the messages in bytes
+	Count    int64 // the number of messages
+}
+
+// exceeded reports whether adding a message of size bytes exceeds q.
+func (q *Quota) exceeded(size int64) bool {
+	return (q.MaxSize > 0 && q.Size+size > q.MaxSize) ||
+		(q.MaxCount > 0 && q.Count+1 > q.MaxCount)
+}
+
+// quotaRoot returns the Maildir holding the maildirsize file of d: the parent
+// of a Maildir++ folder, and d itself otherwise.
+func (d Dir) quotaRoot() Dir {
+	if _, err := os.Stat(filepath.Join(string(d), folderMarker)); err == nil {
+		return Dir(filepath.Dir(filepath.Clean(string(d))))
+	}
+	return d
+}
+
+// Quota reads the Maildir++ quota of d from the maildirsize file of its root,
+// i.e. the parent of d if d is a Maildir++ folder. An error satisfying
+// os.IsNotExist is returned if there is no quota.
+//
+// The usage is the sum of the lines of maildirsize, which may drift from the
+// actual usage of the Maildir, see CompactQuota.
+func (d Dir) Quota() (*Quota, error) {
+	b, err := ioutil.ReadFile(filepath.Join(string(d.quotaRoot()), maildirsizeFile))
+	if err != nil {
+		return nil, err
+	}
+	s := bufio.NewScanner(bytes.NewReader(b))
+	if !s.Scan() {
+		if err := s.Err(); err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("maildir: empty %v", maildirsizeFile)
+	}
+	q := new(Quota)
+	for _, field := range strings.Split(s.Text(), ",") {
+		if field == "" {
+			continue
+		}
+		n, err := strconv.ParseInt(field[:len(field)-1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("maildir: invalid %v quota definition: %q", maildirsizeFile, s.Text())
+		}
+		switch field[len(field)-1] {
+		case 'S':
+			q.MaxSize = n
+		case 'C':
+			q.MaxCount = n
+		}
+	}
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("maildir: invalid %v line: %q", maildirsizeFile, s.Text())
+		}
+		size, err := strconv.ParseInt(fields[0], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("maildir: invalid %v line: %q", maildirsizeFile, s.Text())
+		}
+		count, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("maildir: invalid %v line: %q", maildirsizeFile, s.Text())
+		}
+		q.Size += size
+		q.Count += count
+	}
+	return q, s.Err()
+}
+
+// SetQuota creates or replaces the Maildir++ maildirsize file of d with the
+// given limits, zero meaning no limit, followed by the actual usage of d and
+// all its folders. d must be the root Maildir, not a Maildir++ folder.
+func (d Dir) SetQuota(maxSize, maxCount int64) error {
+	unlock, err := lock(filepath.Join(string(d), maildirsizeLockFile))
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	var def []string
+	if maxSize > 0 {
+		def = append(def, strconv.FormatInt(maxSize, 10)+"S")
+	}
+	if maxCount > 0 {
+		def = append(def, strconv.FormatInt(maxCount, 10)+"C")
+	}
+	size, count, err := d.quotaUsage()
+	if err != nil {
+		return err
+	}
+	data := fmt.Sprintf("%s\n%d %d\n", strings.Join(def, ","), size, count)
+	return writeFileAtomic(d, maildirsizeFile, []byte(data))
+}
+
+// addQuotaUsage appends a line accounting for size bytes and count messages
+// to the maildirsize file of the root of d. An error satisfying os.IsNotExist
+// is returned if there is no such file.
+func (d Dir) addQuotaUsage(size, count int64) error {
+	root := d.quotaRoot()
+	path := filepath.Join(string(root), maildirsizeFile)
+	// don't create the lock file of Maildirs without quota
+	if _, err := os.Stat(path); err != nil {
+		return err
+	}
+	unlock, err := lock(filepath.Join(string(root), maildirsizeLockFile))
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(f, "%d %d\n", size, count)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// removeQuotaUsage records the removal of count messages totalling size bytes
+// in the maildirsize file of the root of d, if any. Since the messages are
+// already gone, errors are reported to Warning.
+func (d Dir) removeQuotaUsage(size, count int64) {
+	if count == 0 {
+		return
+	}
+	err := d.addQuotaUsage(-size, -count)
+	if err != nil && !os.IsNotExist(err) && Warning != nil {
+		Warning(err)
+	}
+}
+
+// CompactQuota rewrites the Maildir++ maildirsize file of the root of d with
+// its quota definition followed by a single line holding the actual size and
+// number of messages, computed from the directories. This prunes the lines
+// accumulated by deliveries and removals, and fixes any drift. The file is
+// replaced atomically, while holding the lock taken by deliveries and
+// removals to update it.
+func (d Dir) CompactQuota() error {
+	root := d.quotaRoot()
+	unlock, err := lock(filepath.Join(string(root), maildirsizeLockFile))
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	b, err := ioutil.ReadFile(filepath.Join(string(root), maildirsizeFile))
+	if err != nil {
+		return err
+	}
+	s := bufio.NewScanner(bytes.NewReader(b))
+	if !s.Scan() {
+		if err := s.Err(); err != nil {
+			return err
+		}
+		return fmt.Errorf("maildir: empty %v", maildirsizeFile)
+	}
+	def := s.Text()
+
+	size, count, err := root.quotaUsage()
+	if err != nil {
+		return err
+	}
+	data := fmt.Sprintf("%s\n%d %d\n", def, size, count)
+	return writeFileAtomic(root, maildirsizeFile, []byte(data))
+}
+
+// quotaUsage returns the total size and number of messages in new and cur of
+// d and all its Maildir++ folders.
+func (d Dir) quotaUsage() (size, count int64, err error) {
+	folders, err := d.Folders()
+	if err != nil {
+		return 0, 0, err
+	}
+	dirs := []Dir{d}
+	for _, name := range folders {
+		folder, err := d.Folder(name)
+		if err != nil {
+			return 0, 0, err
+		}
+		dirs = append(dirs, folder)
+	}
+	for _, dir := range dirs {
+		for _, sub := range []string{"new", "cur"} {
+			path := filepath.Join(string(dir), sub)
+			names, err := readdirnames(path)
+			if err != nil {
+				return 0, 0, err
+			}
+			for _, n := range names {
+				if n[0] == '.' {
+					continue
+				}
+				key, err := parseKey(n)
+				if err != nil {
+					continue
+				}
+				s, ok := keySize(key)
+				if !ok {
+					fi, err := os.Stat(filepath.Join(path, n))
+					if os.IsNotExist(err) {
+						continue
+					} else if err != nil {
+						return 0, 0, err
+					}
+					s = fi.Size()
+				}
+				size += s
+				count++
+			}
+		}
+	}
+	return size, count, nil
+}
@@ -0,0 +1,164 @@
+package maildir
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDir_CompactQuota(t *testing.T) {
+	t.Parallel()
+
+	d := Dir(t.TempDir())
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+	work, err := d.CreateFolder("Work")
+	if err != nil {
+		t.Fatal(err)
+	}
+	makeDelivery(t, d, strings.Repeat("x", 100))
+	makeDelivery(t, d, strings.Repeat("x", 200))
+	if _, err := d.Unseen(); err != nil {
+		t.Fatal(err)
+	}
+	makeDelivery(t, d, strings.Repeat("x", 300))
+	makeDelivery(t, work, strings.Repeat("x", 400))
+
+	// a long ledger which has drifted from the actual usage
+	var ledger strings.Builder
+	ledger.WriteString("1000000S,1000C\n")
+	for i := 0; i < 500; i++ {
+		fmt.Fprintf(&ledger, "%d 1\n", 10+i)
+		if i%2 == 0 {
+			fmt.Fprintf(&ledger, "-%d -1\n", 10+i)
+		}
+	}
+	path := filepath.Join(string(d), maildirsizeFile)
+	if err := ioutil.WriteFile(path, []byte(ledger.String()), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := d.CompactQuota(); err != nil {
+		t.Fatal(err)
+	}
+	want := "1000000S,1000C\n1000 4\n"
+	if got := cat(t, path); got != want {
+		t.Errorf("%v = %q, want %q", maildirsizeFile, got, want)
+	}
+	if entries, err := d.ListTmp(); err != nil {
+		t.Fatal(err)
+	} else if len(entries) != 0 {
+		t.Errorf("Dir.ListTmp() = %v, want no leftover", entries)
+	}
+
+	// compacting a folder compacts the file of its root
+	if err := ioutil.WriteFile(path, []byte(want+"5 1\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := work.CompactQuota(); err != nil {
+		t.Fatal(err)
+	}
+	if got := cat(t, path); got != want {
+		t.Errorf("%v after Dir.CompactQuota() on a folder = %q, want %q", maildirsizeFile, got, want)
+	}
+	if _, err := os.Stat(filepath.Join(string(work), maildirsizeFile)); !os.IsNotExist(err) {
+		t.Errorf("%v created in the folder: %v", maildirsizeFile, err)
+	}
+}
+
+func TestDir_Remove_Quota(t *testing.T) {
+	t.Parallel()
+
+	d := Dir(t.TempDir())
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+	work, err := d.CreateFolder("Work")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.SetQuota(1000, 0); err != nil {
+		t.Fatal(err)
+	}
+	key, err := work.Deliver(strings.NewReader(strings.Repeat("x", 100)), &DeliveryOptions{EnforceQuota: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := work.Remove(key); err != nil {
+		t.Fatal(err)
+	}
+	want := "1000S\n0 0\n100 1\n-100 -1\n"
+	if got := cat(t, filepath.Join(string(d), maildirsizeFile)); got != want {
+		t.Errorf("%v = %q, want %q", maildirsizeFile, got, want)
+	}
+
+	// Purge records all its removals at once
+	for _, content := range []string{"abc", "defgh"} {
+		key, err := work.Deliver(strings.NewReader(content), &DeliveryOptions{EnforceQuota: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := work.Unseen(); err != nil {
+			t.Fatal(err)
+		}
+		if err := work.Trash(key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := work.Purge(); err != nil {
+		t.Fatal(err)
+	}
+	if q, err := work.Quota(); err != nil {
+		t.Fatal(err)
+	} else if q.Size != 0 || q.Count != 0 {
+		t.Errorf("Dir.Quota() after Purge() = %+v, want no usage", q)
+	}
+}
+
+func TestDir_Quota(t *testing.T) {
+	t.Parallel()
+
+	d := Dir(t.TempDir())
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+	work, err := d.CreateFolder("Work")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Quota(); !os.IsNotExist(err) {
+		t.Errorf("Dir.Quota() without maildirsize = %v, want a not exist error", err)
+	}
+	makeDelivery(t, d, strings.Repeat("x", 100))
+	if err := d.SetQuota(250, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	opts := &DeliveryOptions{EnforceQuota: true}
+	if _, err := work.Deliver(strings.NewReader(strings.Repeat("x", 100)), opts); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Deliver(strings.NewReader(strings.Repeat("x", 100)), opts); err != ErrQuotaExceeded {
+		t.Errorf("Dir.Deliver() over quota = %v, want %v", err, ErrQuotaExceeded)
+	}
+	if names, err := readdirnames(filepath.Join(string(d), "tmp")); err != nil {
+		t.Fatal(err)
+	} else if len(names) != 0 {
+		t.Errorf("tmp = %v, want no leftover file", names)
+	}
+
+	for _, dir := range []Dir{d, work} {
+		q, err := dir.Quota()
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := Quota{MaxSize: 250, Size: 200, Count: 2}
+		if *q != want {
+			t.Errorf("Dir.Quota() = %+v, want %+v", *q, want)
+		}
+	}
+}
@@ -0,0 +1,30 @@
+package maildir
+
+import (
+	"os"
+)
+
+// readOnlyMode is the mode of the messages delivered with
+// DeliveryOptions.ReadOnly.
+const readOnlyMode = 0400
+
+// makeWritable makes the file at path writable by its owner if it isn't, so
+// that it can be renamed or removed on platforms such as Windows which refuse
+// to do so for read-only files. The returned function restores the original
+// mode on the file, given its path at that point.
+func makeWritable(path string) (restore func(path string), err error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	mode := fi.Mode().Perm()
+	if mode&0200 != 0 {
+		return func(string) {}, nil
+	}
+	if err := os.Chmod(path, mode|0200); err != nil {
+		return nil, err
+	}
+	return func(path string) {
+		os.Chmod(path, mode)
+	}, nil
+}
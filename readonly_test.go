@@ -0,0 +1,74 @@
+package maildir
+
+import (
+	"os"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestDir_Deliver_ReadOnly(t *testing.T) {
+	t.Parallel()
+
+	d := Dir(t.TempDir())
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+	key, err := d.Deliver(strings.NewReader("Subject: archived\r\n\r\n"), &DeliveryOptions{ReadOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Unseen(); err != nil {
+		t.Fatal(err)
+	}
+
+	mode := func() os.FileMode {
+		filename, err := d.Filename(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fi, err := os.Stat(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return fi.Mode().Perm()
+	}
+	if runtime.GOOS != "windows" && mode() != readOnlyMode {
+		t.Errorf("file mode = %v, want %v", mode(), os.FileMode(readOnlyMode))
+	}
+	if mode()&0200 != 0 {
+		t.Error("delivered file is writable")
+	}
+
+	// flag changes keep the file read-only
+	if err := d.SetFlags(key, []Flag{FlagSeen}); err != nil {
+		t.Fatal(err)
+	}
+	if mode()&0200 != 0 {
+		t.Error("file is writable after a flag change")
+	}
+
+	filename, err := d.Filename(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f, err := os.OpenFile(filename, os.O_WRONLY, 0); err == nil {
+		f.Close()
+		if os.Geteuid() != 0 {
+			t.Error("read-only file opened for writing")
+		}
+	}
+	// Windows also refuses to remove read-only files, Unix only looks at the
+	// permissions of the directory
+	if runtime.GOOS == "windows" {
+		if err := os.Remove(filename); err == nil {
+			t.Fatal("read-only file removed without chmod")
+		}
+	}
+	if err := d.Remove(key); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filename); !os.IsNotExist(err) {
+		t.Errorf("file still exists after Dir.Remove(): %v", err)
+	}
+}
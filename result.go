@@ -0,0 +1,64 @@
+package maildir
+
+import (
+	"context"
+	"errors"
+	"io"
+)
+
+// DeliveryCode classifies the outcome of a delivery, e.g. to map it to an
+// SMTP or LMTP reply.
+type DeliveryCode int
+
+const (
+	// The message has been delivered.
+	DeliverySuccess DeliveryCode = iota
+	// The mailbox is over quota, or the filesystem is full.
+	DeliveryQuotaExceeded
+	// The message exceeds DeliveryOptions.MaxSize.
+	DeliveryTooLarge
+	// The delivery failed, but may succeed if retried later.
+	DeliveryTempFail
+	// The delivery failed, and will fail again if retried.
+	DeliveryPermFail
+	// The message has been discarded by DeliveryOptions.Discard. This isn't
+	// a failure: the message mustn't be bounced.
+	DeliveryDiscarded
+)
+
+// DeliverResult describes the outcome of Dir.DeliverWithResult.
+type DeliverResult struct {
+	Key  string       // the key of the delivered message
+	Size int64        // the number of bytes stored
+	Err  error        // the error which made the delivery fail, if any
+	Code DeliveryCode // the classification of Err
+}
+
+// DeliverWithResult works like Deliver, but reports the outcome of the
+// delivery as a DeliverResult.
+func (d Dir) DeliverWithResult(r io.Reader, opts *DeliveryOptions) DeliverResult {
+	del, err := d.deliver(context.Background(), r, opts, false)
+	if err != nil {
+		return DeliverResult{Err: err, Code: deliveryCode(err)}
+	}
+	return DeliverResult{Key: del.key, Size: del.size, Code: DeliverySuccess}
+}
+
+// deliveryCode classifies a delivery error. Unknown errors are considered
+// temporary, so that the sender retries rather than drop the message.
+func deliveryCode(err error) DeliveryCode {
+	switch {
+	case err == nil:
+		return DeliverySuccess
+	case errors.Is(err, ErrDiscarded):
+		return DeliveryDiscarded
+	case errors.Is(err, ErrMessageTooLarge):
+		return DeliveryTooLarge
+	case errors.Is(err, ErrQuotaExceeded), errors.Is(err, errNoSpace), errors.Is(err, errQuota):
+		return DeliveryQuotaExceeded
+	case errors.Is(err, ErrLoopDetected):
+		return DeliveryPermFail
+	default:
+		return DeliveryTempFail
+	}
+}
@@ -0,0 +1,116 @@
+package maildir
+
+import (
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestDir_DeliverWithResult(t *testing.T) {
+	t.Parallel()
+
+	d := Dir(t.TempDir())
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	const msg = "Delivered-To: bob@example.org\r\n\r\nhello\r\n"
+	res := d.DeliverWithResult(strings.NewReader(msg), nil)
+	if res.Err != nil || res.Code != DeliverySuccess {
+		t.Fatalf("DeliverResult = %+v, want success", res)
+	}
+	if res.Size != int64(len(msg)) {
+		t.Errorf("DeliverResult.Size = %v, want %v", res.Size, len(msg))
+	}
+	if _, err := d.Unseen(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Filename(res.Key); err != nil {
+		t.Error(err)
+	}
+
+	quota := Dir(t.TempDir())
+	if err := quota.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if err := quota.SetQuota(5, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, tc := range map[string]struct {
+		d    Dir
+		opts *DeliveryOptions
+		want DeliveryCode
+	}{
+		"too large": {d, &DeliveryOptions{MaxSize: 5}, DeliveryTooLarge},
+		"loop":      {d, &DeliveryOptions{DeliveredTo: "bob@example.org"}, DeliveryPermFail},
+		"full disk": {d, &DeliveryOptions{
+			Transform: func(r io.Reader) io.Reader {
+				return iotest.ErrReader(errNoSpace)
+			},
+		}, DeliveryQuotaExceeded},
+		"over quota":      {quota, &DeliveryOptions{EnforceQuota: true}, DeliveryQuotaExceeded},
+		"missing maildir": {Dir(filepath.Join(string(d), "missing")), nil, DeliveryTempFail},
+	} {
+		res := tc.d.DeliverWithResult(strings.NewReader(msg), tc.opts)
+		if res.Err == nil {
+			t.Errorf("%v: DeliverResult.Err is nil", name)
+		}
+		if res.Code != tc.want {
+			t.Errorf("%v: DeliverResult.Code = %v, want %v", name, res.Code, tc.want)
+		}
+	}
+}
+
+func TestDir_DeliverWithResult_Discard(t *testing.T) {
+	t.Parallel()
+
+	d := Dir(t.TempDir())
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	const msg = "Subject: spam\r\n\r\nbuy now\r\n"
+	var scanned string
+	opts := &DeliveryOptions{
+		TmpFile: true,
+		Discard: func(tmppath string) bool {
+			b, err := ioutil.ReadFile(tmppath)
+			if err != nil {
+				t.Error(err)
+			}
+			scanned = string(b)
+			return strings.Contains(scanned, "buy now")
+		},
+	}
+	res := d.DeliverWithResult(strings.NewReader(msg), opts)
+	if res.Code != DeliveryDiscarded || res.Err != ErrDiscarded {
+		t.Errorf("DeliverResult = %+v, want a discarded delivery", res)
+	}
+	if scanned != msg {
+		t.Errorf("scanned message = %q, want %q", scanned, msg)
+	}
+	if n, err := d.UnseenCount(); err != nil {
+		t.Fatal(err)
+	} else if n != 0 {
+		t.Errorf("Dir.UnseenCount() = %v, want 0", n)
+	}
+	if n, err := d.TotalCount(); err != nil {
+		t.Fatal(err)
+	} else if n != 0 {
+		t.Errorf("Dir.TotalCount() = %v, want 0", n)
+	}
+	if entries, err := d.ListTmp(); err != nil {
+		t.Fatal(err)
+	} else if len(entries) != 0 {
+		t.Errorf("Dir.ListTmp() = %v, want no leftover", entries)
+	}
+
+	// messages which aren't discarded are delivered
+	if res := d.DeliverWithResult(strings.NewReader("Subject: ham\r\n\r\n"), opts); res.Code != DeliverySuccess {
+		t.Errorf("DeliverResult = %+v, want success", res)
+	}
+}
@@ -0,0 +1,54 @@
+package maildir
+
+import (
+	"context"
+	"io"
+	"path/filepath"
+)
+
+// A Session delivers several messages to a Maildir, deferring the
+// synchronization of the new directory until Commit.
+//
+// Each message is flushed to stable storage before being moved to new, but the
+// directory entries pointing to them are only guaranteed to be durable once
+// Commit returns: messages delivered since the last Commit may be lost after a
+// crash. This is much cheaper than synchronizing new after each delivery when
+// many messages are delivered in a row, e.g. in an LMTP session.
+//
+// A Session isn't safe for concurrent use.
+type Session struct {
+	d     Dir
+	dirty map[string]bool // subdirectories to synchronize
+}
+
+// NewSession starts a new delivery session.
+func (d Dir) NewSession() *Session {
+	return &Session{d: d, dirty: make(map[string]bool)}
+}
+
+// Deliver delivers the message read from r to new and returns its key, like
+// Dir.Deliver with DeliveryOptions.Sync set.
+func (s *Session) Deliver(r io.Reader, opts *DeliveryOptions) (string, error) {
+	o := DeliveryOptions{}
+	if opts != nil {
+		o = *opts
+	}
+	o.Sync = true
+	del, err := s.d.deliver(context.Background(), r, &o, true)
+	if err != nil {
+		return "", err
+	}
+	s.dirty[del.subdir()] = true
+	return del.key, nil
+}
+
+// Commit makes all the messages delivered so far in the session durable.
+func (s *Session) Commit() error {
+	for subdir := range s.dirty {
+		if err := syncDir(filepath.Join(string(s.d), subdir)); err != nil {
+			return err
+		}
+		delete(s.dirty, subdir)
+	}
+	return nil
+}
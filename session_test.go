@@ -0,0 +1,91 @@
+package maildir
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSession(t *testing.T) {
+	t.Parallel()
+
+	d := Dir(t.TempDir())
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	s := d.NewSession()
+	var keys []string
+	for i := 0; i < 3; i++ {
+		key, err := s.Deliver(strings.NewReader(fmt.Sprintf("message number %d", i)), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, key)
+	}
+	if !s.dirty["new"] {
+		t.Error("session should have pending deliveries")
+	}
+	if err := s.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if len(s.dirty) != 0 {
+		t.Error("session still has pending deliveries after Commit")
+	}
+
+	for i, key := range keys {
+		path := filepath.Join(string(d), "new", key)
+		if cat(t, path) != fmt.Sprintf("message number %d", i) {
+			t.Errorf("Content of %v doesn't match", key)
+		}
+	}
+	if entries, err := d.ListTmp(); err != nil {
+		t.Fatal(err)
+	} else if len(entries) != 0 {
+		t.Errorf("Dir.ListTmp() = %v, want no leftover", entries)
+	}
+}
+
+// benchmarkDeliver measures the deliveries done by the function returned by
+// start, followed by a call to the returned commit function.
+func benchmarkDeliver(b *testing.B, start func(d Dir) (deliver, commit func() error)) {
+	d := Dir(b.TempDir())
+	if err := d.Init(); err != nil {
+		b.Fatal(err)
+	}
+	deliver, commit := start(d)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := deliver(); err != nil {
+			b.Fatal(err)
+		}
+	}
+	if err := commit(); err != nil {
+		b.Fatal(err)
+	}
+}
+
+func BenchmarkDeliver_Sync(b *testing.B) {
+	benchmarkDeliver(b, func(d Dir) (deliver, commit func() error) {
+		deliver = func() error {
+			_, err := d.Deliver(strings.NewReader("a message"), &DeliveryOptions{Sync: true})
+			return err
+		}
+		commit = func() error {
+			return nil
+		}
+		return deliver, commit
+	})
+}
+
+func BenchmarkDeliver_Session(b *testing.B) {
+	benchmarkDeliver(b, func(d Dir) (deliver, commit func() error) {
+		s := d.NewSession()
+		deliver = func() error {
+			_, err := s.Deliver(strings.NewReader("a message"), nil)
+			return err
+		}
+		return deliver, s.Commit
+	})
+}
@@ -0,0 +1,236 @@
+package maildir
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// uidlistFile is the name of the file where Dovecot stores the IMAP UIDs of
+// the messages of a Maildir.
+const uidlistFile = "dovecot-uidlist"
+
+// uidlistLockFile is the dotlock Dovecot takes while it updates uidlistFile.
+// The new content of uidlistFile is written to the lock file, which is then
+// renamed over uidlistFile.
+const uidlistLockFile = uidlistFile + ".lock"
+
+// sidecarLockFile is the name of the lock file, in the Maildir root,
+// serializing the updates of the checksum and modification sequence files by
+// this package.
+const sidecarLockFile = "maildir-sidecar-lock"
+
+// lockSidecars takes the lock serializing the updates of the sidecar files of
+// d owned by this package, and returns a function releasing it.
+func (d Dir) lockSidecars() (unlock func(), err error) {
+	return lock(filepath.Join(string(d), sidecarLockFile))
+}
+
+// uidlistLockTimeout is how long forgetKeys waits for Dovecot to release
+// uidlistLockFile before giving up.
+var uidlistLockTimeout = 10 * time.Second
+
+// A SidecarError is reported to Warning when the sidecar files of the Maildir
+// root can't be updated after messages have been removed. The messages are
+// removed nonetheless, and the sidecar files are left with dangling entries.
+type SidecarError struct {
+	Keys []string // the keys of the removed messages
+	Err  error
+}
+
+func (e *SidecarError) Error() string {
+	return fmt.Sprintf("maildir: failed to forget %d removed messages: %v", len(e.Keys), e.Err)
+}
+
+func (e *SidecarError) Unwrap() error {
+	return e.Err
+}
+
+// forgetKeys removes all the references to keys from the sidecar files
+// present in the Maildir root, so that they don't grow with dangling entries.
+// Each file is rewritten at most once. Errors are reported to Warning as a
+// *SidecarError, since the messages are already gone.
+func (d Dir) forgetKeys(keys []string) {
+	if len(keys) == 0 {
+		return
+	}
+	if err := d.forgetKeysErr(keys); err != nil && Warning != nil {
+		Warning(&SidecarError{keys, err})
+	}
+}
+
+// forgetKeysErr does the work of forgetKeys. All the sidecar files are
+// updated even if one fails, and the first error is returned.
+func (d Dir) forgetKeysErr(keys []string) error {
+	forget := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		forget[trimInfo(key)] = true
+	}
+
+	errs := []error{
+		d.forgetOwnSidecars(forget),
+		// the first line is a header, each other line is
+		// "<uid> [fields] :<name>"
+		d.filterUIDList(func(i int, line string) bool {
+			j := strings.Index(line, " :")
+			if i == 0 || j < 0 {
+				return true
+			}
+			k, err := parseKey(line[j+len(" :"):])
+			return err != nil || !forget[k]
+		}),
+	}
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// forgetOwnSidecars removes the keys in forget from the checksum and
+// modification sequence files, under the lock taken by their other writers.
+// The lock isn't taken, and so its file isn't created, if neither file exists.
+func (d Dir) forgetOwnSidecars(forget map[string]bool) error {
+	exists := false
+	for _, name := range []string{checksumFile, modseqFile} {
+		if _, err := os.Stat(filepath.Join(string(d), name)); err == nil {
+			exists = true
+		}
+	}
+	if !exists {
+		return nil
+	}
+	unlock, err := d.lockSidecars()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	err = d.forgetModSeqs(forget)
+	if checksumErr := d.filterLines(checksumFile, func(i int, line string) bool {
+		fields := strings.Fields(line)
+		return len(fields) != 2 || !forget[fields[1]]
+	}); err == nil {
+		err = checksumErr
+	}
+	return err
+}
+
+// forgetModSeqs removes the modification sequences of the keys in forget.
+func (d Dir) forgetModSeqs(forget map[string]bool) error {
+	ms, err := d.readModSeqs()
+	if err != nil {
+		return err
+	}
+	changed := false
+	for key := range forget {
+		if _, ok := ms.keys[key]; ok {
+			delete(ms.keys, key)
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+	return d.writeModSeqs(ms)
+}
+
+// filterLines rewrites the file name in the Maildir root, keeping only the
+// lines for which keep returns true. Nothing is done if the file doesn't exist
+// or if all its lines are kept.
+func (d Dir) filterLines(name string, keep func(i int, line string) bool) error {
+	b, err := ioutil.ReadFile(filepath.Join(string(d), name))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if b, changed := filterContent(b, keep); changed {
+		return writeFileAtomic(d, name, b)
+	}
+	return nil
+}
+
+// filterUIDList works like filterLines for Dovecot's uidlistFile, while
+// holding Dovecot's dotlock so that a running Dovecot doesn't lose its own
+// updates.
+func (d Dir) filterUIDList(keep func(i int, line string) bool) error {
+	path := filepath.Join(string(d), uidlistFile)
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return nil
+	}
+
+	lockPath := filepath.Join(string(d), uidlistLockFile)
+	lock, err := createDotlock(lockPath, uidlistLockTimeout)
+	if err != nil {
+		return err
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		lock.Close()
+		os.Remove(lockPath)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	b, changed := filterContent(b, keep)
+	if !changed {
+		lock.Close()
+		return os.Remove(lockPath)
+	}
+	_, err = lock.Write(b)
+	if err == nil {
+		err = lock.Sync()
+	}
+	if closeErr := lock.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(lockPath, path)
+	}
+	if err != nil {
+		os.Remove(lockPath)
+	}
+	return err
+}
+
+// createDotlock creates the file at path exclusively, waiting for at most
+// timeout if it already exists.
+func createDotlock(path string, timeout time.Duration) (*os.File, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if err == nil || !os.IsExist(err) {
+			return f, err
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("maildir: timeout waiting for %v", path)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// filterContent returns the lines of b for which keep returns true, and
+// whether any line has been dropped.
+func filterContent(b []byte, keep func(i int, line string) bool) ([]byte, bool) {
+	lines := bytes.SplitAfter(b, []byte("\n"))
+	var buf bytes.Buffer
+	changed := false
+	for i, line := range lines {
+		if len(line) == 0 {
+			continue
+		}
+		if keep(i, strings.TrimRight(string(line), "\r\n")) {
+			buf.Write(line)
+		} else {
+			changed = true
+		}
+	}
+	return buf.Bytes(), changed
+}
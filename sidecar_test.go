@@ -0,0 +1,216 @@
+package maildir
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDir_Remove_Sidecars(t *testing.T) {
+	t.Parallel()
+
+	d := Dir(t.TempDir())
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+	var keys []string
+	for i := 0; i < 2; i++ {
+		key, err := d.Deliver(strings.NewReader("a message"), &DeliveryOptions{Checksum: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, key)
+	}
+	if _, err := d.Unseen(); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range keys {
+		if _, err := d.SetFlagsModSeq(key, []Flag{FlagSeen}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	uidlist := "3 V1600000000 N3 G0123456789abcdef\n" +
+		"1 :" + keys[0] + "\n" +
+		"2 G0123 :" + keys[1] + "\n"
+	if err := ioutil.WriteFile(filepath.Join(string(d), uidlistFile), []byte(uidlist), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := d.Remove(keys[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{uidlistFile, checksumFile, modseqFile} {
+		content := cat(t, filepath.Join(string(d), name))
+		if strings.Contains(content, keys[0]) {
+			t.Errorf("%v still references the removed message:\n%v", name, content)
+		}
+		if !strings.Contains(content, keys[1]) {
+			t.Errorf("%v doesn't reference the remaining message anymore:\n%v", name, content)
+		}
+	}
+	if got, want := cat(t, filepath.Join(string(d), uidlistFile)), "3 V1600000000 N3 G0123456789abcdef\n2 G0123 :"+keys[1]+"\n"; got != want {
+		t.Errorf("%v = %q, want %q", uidlistFile, got, want)
+	}
+}
+
+func TestDir_Remove_concurrentChecksums(t *testing.T) {
+	t.Parallel()
+
+	d := Dir(t.TempDir())
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+	var removed []string
+	for i := 0; i < 20; i++ {
+		key, err := d.Deliver(strings.NewReader("removed"), &DeliveryOptions{Checksum: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		removed = append(removed, key)
+	}
+
+	keys := make([]string, 50)
+	errs := make([]error, len(keys))
+	var wg sync.WaitGroup
+	for i := range keys {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			keys[i], errs[i] = d.Deliver(strings.NewReader(fmt.Sprintf("kept %d", i)), &DeliveryOptions{Checksum: true})
+		}(i)
+	}
+	for _, key := range removed {
+		if err := d.Remove(key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wg.Wait()
+
+	checksums, err := d.readChecksums()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, key := range keys {
+		if errs[i] != nil {
+			t.Fatal(errs[i])
+		} else if _, ok := checksums[key]; !ok {
+			t.Errorf("checksum of %v lost", key)
+		}
+	}
+	if len(checksums) != len(keys) {
+		t.Errorf("got %v checksums, want %v", len(checksums), len(keys))
+	}
+}
+
+func TestDir_Remove_SidecarErrors(t *testing.T) {
+	// don't run this test in // as it sets package variables
+	d := Dir(t.TempDir())
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+	key, err := d.Deliver(strings.NewReader("a message"), &DeliveryOptions{Checksum: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Unseen(); err != nil {
+		t.Fatal(err)
+	}
+	uidlist := "3 V1600000000 N3 G0123456789abcdef\n1 :" + key + "\n"
+	if err := ioutil.WriteFile(filepath.Join(string(d), uidlistFile), []byte(uidlist), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(string(d), modseqFile), []byte("not a number\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	// Dovecot holds its lock on the UID list
+	lockPath := filepath.Join(string(d), uidlistLockFile)
+	if err := ioutil.WriteFile(lockPath, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	var warnings []error
+	Warning = func(err error) {
+		warnings = append(warnings, err)
+	}
+	uidlistLockTimeout = 100 * time.Millisecond
+	defer func() {
+		Warning = nil
+		uidlistLockTimeout = 10 * time.Second
+	}()
+
+	if err := d.Remove(key); err != nil {
+		t.Fatalf("Dir.Remove() = %v, want the message removed", err)
+	}
+	if _, err := d.Filename(key); !isNotFound(err) {
+		t.Errorf("Dir.Filename() after Remove = %v, want a missing message", err)
+	}
+	var sidecarErr *SidecarError
+	if len(warnings) != 1 || !errors.As(warnings[0], &sidecarErr) {
+		t.Fatalf("warnings = %v, want a single *SidecarError", warnings)
+	}
+	// the other sidecar files are still updated
+	if content := cat(t, filepath.Join(string(d), checksumFile)); strings.Contains(content, key) {
+		t.Errorf("%v still references the removed message:\n%v", checksumFile, content)
+	}
+	// the UID list isn't touched while Dovecot holds the lock
+	if got := cat(t, filepath.Join(string(d), uidlistFile)); got != uidlist {
+		t.Errorf("%v = %q, want %q", uidlistFile, got, uidlist)
+	}
+}
+
+func TestDir_Purge_UIDListLock(t *testing.T) {
+	t.Parallel()
+
+	d := Dir(t.TempDir())
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+	var keys []string
+	uidlist := "4 V1600000000 N4 G0123456789abcdef\n"
+	for i := 0; i < 3; i++ {
+		key, err := d.Deliver(strings.NewReader("a message"), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, key)
+		uidlist += fmt.Sprintf("%d :%s\n", i+1, key)
+	}
+	if _, err := d.Unseen(); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range keys[:2] {
+		if err := d.Trash(key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(string(d), uidlistFile), []byte(uidlist), 0600); err != nil {
+		t.Fatal(err)
+	}
+	// Dovecot releases its lock shortly
+	lockPath := filepath.Join(string(d), uidlistLockFile)
+	if err := ioutil.WriteFile(lockPath, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		os.Remove(lockPath)
+	}()
+
+	if _, err := d.Purge(); err != nil {
+		t.Fatal(err)
+	}
+	want := "4 V1600000000 N4 G0123456789abcdef\n3 :" + keys[2] + "\n"
+	if got := cat(t, filepath.Join(string(d), uidlistFile)); got != want {
+		t.Errorf("%v = %q, want %q", uidlistFile, got, want)
+	}
+	if _, err := os.Stat(lockPath); !os.IsNotExist(err) {
+		t.Errorf("%v left behind", uidlistLockFile)
+	}
+}
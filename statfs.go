@@ -0,0 +1,16 @@
+package maildir
+
+import (
+	"errors"
+)
+
+// errStatfsUnsupported is returned by Dir.Available on platforms where the
+// free space can't be queried.
+var errStatfsUnsupported = errors.New("maildir: free space not available on this platform")
+
+// Available returns the number of bytes available to the current user on the
+// filesystem holding d, e.g. to reject a large delivery with a temporary
+// failure before accepting it.
+func (d Dir) Available() (freeBytes int64, err error) {
+	return available(string(d))
+}
@@ -0,0 +1,8 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !windows
+// +build !darwin,!dragonfly,!freebsd,!linux,!windows
+
+package maildir
+
+func available(path string) (int64, error) {
+	return 0, errStatfsUnsupported
+}
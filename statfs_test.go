@@ -0,0 +1,27 @@
+package maildir
+
+import (
+	"testing"
+)
+
+func TestDir_Available(t *testing.T) {
+	t.Parallel()
+
+	d := Dir(t.TempDir())
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+	free, err := d.Available()
+	if err == errStatfsUnsupported {
+		t.Skip(err)
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	if free <= 0 {
+		t.Errorf("Dir.Available() = %v, want a positive value", free)
+	}
+
+	if _, err := Dir(string(d) + "/missing").Available(); err == nil {
+		t.Error("Dir.Available() succeeded on a missing directory")
+	}
+}
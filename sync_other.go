@@ -0,0 +1,21 @@
+//go:build !windows
+// +build !windows
+
+package maildir
+
+import (
+	"os"
+)
+
+// syncDir flushes the entries of a directory to stable storage.
+func syncDir(dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = f.Sync()
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
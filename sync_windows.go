@@ -0,0 +1,6 @@
+package maildir
+
+// syncDir is a no-op on Windows, where directories can't be synchronized.
+func syncDir(dir string) error {
+	return nil
+}
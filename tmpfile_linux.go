@@ -0,0 +1,54 @@
+//go:build linux && (386 || amd64 || arm || arm64 || loong64 || mips || mips64 || mips64le || mipsle || ppc64 || ppc64le || riscv64 || s390x)
+// +build linux
+// +build 386 amd64 arm arm64 loong64 mips mips64 mips64le mipsle ppc64 ppc64le riscv64 s390x
+
+package maildir
+
+import (
+	"os"
+	"strconv"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	// oTmpFile is O_TMPFILE, which the syscall package lacks. __O_TMPFILE is
+	// 020000000 on all the architectures above, it differs on alpha, parisc
+	// and sparc.
+	oTmpFile        = 0x400000 | syscall.O_DIRECTORY
+	atFdCwd         = -100
+	atSymlinkFollow = 0x400
+)
+
+// openTmpFile creates an unnamed file in dir with O_TMPFILE. It is opened for
+// reading too, so that it can be copied if linkTmpFile fails.
+func openTmpFile(dir string) (*os.File, error) {
+	return os.OpenFile(dir, os.O_RDWR|oTmpFile, 0666)
+}
+
+// testHookLinkTmpFile, if set, replaces linkat in linkTmpFile, e.g. to
+// simulate a missing /proc.
+var testHookLinkTmpFile func(f *os.File, newpath string) error
+
+// linkTmpFile gives the unnamed file f the name newpath, with linkat.
+func linkTmpFile(f *os.File, newpath string) error {
+	if testHookLinkTmpFile != nil {
+		return testHookLinkTmpFile(f, newpath)
+	}
+	oldpath := "/proc/self/fd/" + strconv.Itoa(int(f.Fd()))
+	oldp, err := syscall.BytePtrFromString(oldpath)
+	if err != nil {
+		return err
+	}
+	newp, err := syscall.BytePtrFromString(newpath)
+	if err != nil {
+		return err
+	}
+	cwd := atFdCwd
+	_, _, errno := syscall.Syscall6(syscall.SYS_LINKAT, uintptr(cwd), uintptr(unsafe.Pointer(oldp)),
+		uintptr(cwd), uintptr(unsafe.Pointer(newp)), atSymlinkFollow, 0)
+	if errno != 0 {
+		return &os.LinkError{Op: "linkat", Old: oldpath, New: newpath, Err: errno}
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+package maildir
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestDelivery_TmpFile(t *testing.T) {
+	t.Parallel()
+
+	d := Dir(t.TempDir())
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	del, err := NewDeliveryWithOptions(string(d), &DeliveryOptions{TmpFile: true, Sync: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !del.unnamed {
+		del.Abort()
+		t.Skip("O_TMPFILE isn't supported by the filesystem")
+	}
+	const msg = "an unnamed message"
+	if _, err := del.Write([]byte(msg)); err != nil {
+		t.Fatal(err)
+	}
+	if entries, err := d.ListTmp(); err != nil {
+		t.Fatal(err)
+	} else if len(entries) != 0 {
+		t.Errorf("Dir.ListTmp() during the delivery = %v, want none", entries)
+	}
+	if n, err := d.UnseenCount(); err != nil {
+		t.Fatal(err)
+	} else if n != 0 {
+		t.Error("message published before Close")
+	}
+
+	if err := del.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if cat(t, filepath.Join(string(d), "new", del.key)) != msg {
+		t.Error("Content doesn't match")
+	}
+	if entries, err := d.ListTmp(); err != nil {
+		t.Fatal(err)
+	} else if len(entries) != 0 {
+		t.Errorf("Dir.ListTmp() after the delivery = %v, want none", entries)
+	}
+
+	// aborted deliveries leave nothing behind
+	del, err = NewDeliveryWithOptions(string(d), &DeliveryOptions{TmpFile: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := del.Abort(); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := d.TotalCount(); err != nil {
+		t.Fatal(err)
+	} else if n != 1 {
+		t.Errorf("Dir.TotalCount() = %v, want 1", n)
+	}
+}
+
+func TestDelivery_TmpFile_linkFailure(t *testing.T) {
+	d := Dir(t.TempDir())
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	del, err := NewDeliveryWithOptions(string(d), &DeliveryOptions{TmpFile: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !del.unnamed {
+		del.Abort()
+		t.Skip("O_TMPFILE isn't supported by the filesystem")
+	}
+	const msg = "a message delivered without /proc"
+	if _, err := del.Write([]byte(msg)); err != nil {
+		t.Fatal(err)
+	}
+
+	testHookLinkTmpFile = func(f *os.File, newpath string) error {
+		return &os.LinkError{Op: "linkat", Old: "/proc/self/fd/3", New: newpath, Err: syscall.ENOENT}
+	}
+	defer func() {
+		testHookLinkTmpFile = nil
+	}()
+	if err := del.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if cat(t, filepath.Join(string(d), "new", del.key)) != msg {
+		t.Error("Content doesn't match")
+	}
+	if entries, err := d.ListTmp(); err != nil {
+		t.Fatal(err)
+	} else if len(entries) != 0 {
+		t.Errorf("Dir.ListTmp() after the delivery = %v, want none", entries)
+	}
+}
@@ -0,0 +1,21 @@
+//go:build !linux || !(386 || amd64 || arm || arm64 || loong64 || mips || mips64 || mips64le || mipsle || ppc64 || ppc64le || riscv64 || s390x)
+// +build !linux !386,!amd64,!arm,!arm64,!loong64,!mips,!mips64,!mips64le,!mipsle,!ppc64,!ppc64le,!riscv64,!s390x
+
+package maildir
+
+import (
+	"errors"
+	"os"
+)
+
+var errTmpFileUnsupported = errors.New("maildir: unnamed temporary files are not supported")
+
+// openTmpFile always fails: O_TMPFILE is Linux-specific.
+func openTmpFile(dir string) (*os.File, error) {
+	return nil, errTmpFileUnsupported
+}
+
+// linkTmpFile always fails: O_TMPFILE is Linux-specific.
+func linkTmpFile(f *os.File, newpath string) error {
+	return errTmpFileUnsupported
+}
@@ -0,0 +1,206 @@
+package maildir
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"time"
+)
+
+// A WatchOp describes a change reported by Dir.Watch.
+type WatchOp int
+
+const (
+	// WatchNew is reported when a message arrives in new.
+	WatchNew WatchOp = iota + 1
+	// WatchMoved is reported when a message is moved from new to cur.
+	WatchMoved
+	// WatchFlags is reported when the flags of a message in cur change.
+	WatchFlags
+	// WatchRemoved is reported when a message is removed.
+	WatchRemoved
+)
+
+func (op WatchOp) String() string {
+	switch op {
+	case WatchNew:
+		return "new"
+	case WatchMoved:
+		return "moved"
+	case WatchFlags:
+		return "flags"
+	case WatchRemoved:
+		return "removed"
+	}
+	return "unknown"
+}
+
+// A WatchEvent is a change to the messages of a Maildir reported by Dir.Watch.
+type WatchEvent struct {
+	Op    WatchOp
+	Key   string // the key of the message, unset if Err is set
+	Flags []Flag // the flags of the message, if it is in cur
+	Err   error  // the error which occurred while scanning the Maildir
+}
+
+// watchState is the location of a message, as seen by Dir.Watch.
+type watchState struct {
+	sub  string // "new" or "cur"
+	name string // the basename of the message file
+}
+
+// A watchBackend tells Dir.Watch when the entries of new and cur may have
+// changed.
+type watchBackend interface {
+	// wait blocks until the entries may have changed since the previous call,
+	// or until ctx is done.
+	wait(ctx context.Context) error
+	close() error
+}
+
+// pollBackend is the watchBackend used when change notifications aren't
+// available: it reports a possible change every interval.
+type pollBackend struct {
+	ticker *time.Ticker
+}
+
+func newPollBackend(interval time.Duration) *pollBackend {
+	return &pollBackend{time.NewTicker(interval)}
+}
+
+func (b *pollBackend) wait(ctx context.Context) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-b.ticker.C:
+		return nil
+	}
+}
+
+func (b *pollBackend) close() error {
+	b.ticker.Stop()
+	return nil
+}
+
+// Watch reports the changes to the messages of d on the returned channel:
+// arrivals in new, moves to cur, flag changes and removals. The channel is
+// closed once ctx is done.
+//
+// On Linux, changes are detected with inotify. Elsewhere, or if inotify isn't
+// available, new and cur are listed every interval instead, which works on all
+// filesystems, including network ones where change notifications aren't
+// available; changes reverted within an interval may then not be reported.
+// The interval must be positive even if it ends up unused. Errors occurring
+// while watching are reported as events with Err set, and watching goes on,
+// by polling if the notifications failed.
+func (d Dir) Watch(ctx context.Context, interval time.Duration) (<-chan WatchEvent, error) {
+	if interval <= 0 {
+		return nil, fmt.Errorf("maildir: invalid watch interval %v", interval)
+	}
+	var backend watchBackend
+	// the directories are watched before the first snapshot, so that no
+	// change is missed in between
+	if b, err := newNotifyBackend(d); err == nil {
+		backend = b
+	} else {
+		backend = newPollBackend(interval)
+	}
+	return d.watch(ctx, backend, interval)
+}
+
+// watch implements Watch with the given backend, falling back to polling
+// every interval if it fails.
+func (d Dir) watch(ctx context.Context, backend watchBackend, interval time.Duration) (<-chan WatchEvent, error) {
+	prev, err := d.watchSnapshot()
+	if err != nil {
+		backend.close()
+		return nil, err
+	}
+	ch := make(chan WatchEvent)
+	go func() {
+		defer close(ch)
+		defer func() {
+			backend.close()
+		}()
+		for {
+			var events []WatchEvent
+			if err := backend.wait(ctx); ctx.Err() != nil {
+				return
+			} else if err != nil {
+				backend.close()
+				backend = newPollBackend(interval)
+				events = []WatchEvent{{Err: err}}
+			}
+
+			cur, err := d.watchSnapshot()
+			if err != nil {
+				events = append(events, WatchEvent{Err: err})
+			} else {
+				events = append(events, diffWatchStates(prev, cur)...)
+				prev = cur
+			}
+			for _, ev := range events {
+				select {
+				case ch <- ev:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return ch, nil
+}
+
+// watchSnapshot returns the location of each message of d, by key.
+func (d Dir) watchSnapshot() (map[string]watchState, error) {
+	states := make(map[string]watchState)
+	for _, sub := range []string{"new", "cur"} {
+		names, err := readdirnames(filepath.Join(string(d), sub))
+		if err != nil {
+			return nil, err
+		}
+		for _, n := range names {
+			if n[0] == '.' || (sub == "cur" && !completeName(n)) {
+				continue
+			}
+			key, err := parseKey(n)
+			if err != nil {
+				continue
+			}
+			// a message being moved to cur may briefly be in both
+			if _, ok := states[key]; !ok || sub == "cur" {
+				states[key] = watchState{sub, n}
+			}
+		}
+	}
+	return states, nil
+}
+
+// diffWatchStates returns the events turning prev into cur.
+func diffWatchStates(prev, cur map[string]watchState) []WatchEvent {
+	var events []WatchEvent
+	for key, st := range cur {
+		old, ok := prev[key]
+		var flags []Flag
+		if st.sub == "cur" {
+			flags, _ = parseFlags(st.name)
+		}
+		switch {
+		case !ok && st.sub == "new":
+			events = append(events, WatchEvent{Op: WatchNew, Key: key})
+		case !ok:
+			// delivered straight to cur, or moved there within an interval
+			events = append(events, WatchEvent{Op: WatchNew, Key: key, Flags: flags})
+		case old.sub != st.sub:
+			events = append(events, WatchEvent{Op: WatchMoved, Key: key, Flags: flags})
+		case old.name != st.name:
+			events = append(events, WatchEvent{Op: WatchFlags, Key: key, Flags: flags})
+		}
+	}
+	for key := range prev {
+		if _, ok := cur[key]; !ok {
+			events = append(events, WatchEvent{Op: WatchRemoved, Key: key})
+		}
+	}
+	return events
+}
@@ -0,0 +1,76 @@
+package maildir
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// inotifyMask selects the inotify events changing the entries of a directory.
+const inotifyMask = syscall.IN_CREATE | syscall.IN_DELETE | syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO
+
+// inotifyBackend is the watchBackend of Linux, using inotify(7).
+type inotifyBackend struct {
+	f       *os.File
+	changed chan struct{}
+	errs    chan error
+}
+
+// newNotifyBackend watches new and cur of d with inotify.
+func newNotifyBackend(d Dir) (watchBackend, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_NONBLOCK | syscall.IN_CLOEXEC)
+	if err != nil {
+		return nil, os.NewSyscallError("inotify_init1", err)
+	}
+	for _, sub := range []string{"new", "cur"} {
+		path := filepath.Join(string(d), sub)
+		if _, err := syscall.InotifyAddWatch(fd, path, inotifyMask); err != nil {
+			syscall.Close(fd)
+			return nil, &os.PathError{Op: "inotify_add_watch", Path: path, Err: err}
+		}
+	}
+	b := &inotifyBackend{
+		// the file is non-blocking, so that closing it interrupts read
+		f:       os.NewFile(uintptr(fd), "inotify"),
+		changed: make(chan struct{}, 1),
+		errs:    make(chan error, 1),
+	}
+	go b.read()
+	return b, nil
+}
+
+// read turns the inotify events into notifications on changed, coalescing
+// them until wait is called.
+func (b *inotifyBackend) read() {
+	// large enough for at least one event with the longest filename
+	buf := make([]byte, 64*1024)
+	for {
+		if _, err := b.f.Read(buf); err != nil {
+			if !errors.Is(err, os.ErrClosed) {
+				b.errs <- err
+			}
+			return
+		}
+		select {
+		case b.changed <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (b *inotifyBackend) wait(ctx context.Context) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-b.changed:
+		return nil
+	case err := <-b.errs:
+		return err
+	}
+}
+
+func (b *inotifyBackend) close() error {
+	return b.f.Close()
+}
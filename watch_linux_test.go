@@ -0,0 +1,42 @@
+package maildir
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDir_Watch_inotify(t *testing.T) {
+	t.Parallel()
+
+	d := Dir(t.TempDir())
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// changes are reported long before the polling interval
+	events, err := d.Watch(ctx, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := d.Deliver(strings.NewReader("Subject: hello\r\n\r\n"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case ev := <-events:
+		if ev.Err != nil {
+			t.Fatal(ev.Err)
+		} else if ev.Op != WatchNew || ev.Key != key {
+			t.Errorf("event %v for %q, want %v for %q", ev.Op, ev.Key, WatchNew, key)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no event")
+	}
+
+	cancel()
+	for range events {
+	}
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package maildir
+
+import (
+	"errors"
+)
+
+// newNotifyBackend always fails: change notifications are only implemented on
+// Linux, elsewhere Dir.Watch polls.
+func newNotifyBackend(d Dir) (watchBackend, error) {
+	return nil, errors.New("maildir: change notifications are not supported")
+}
@@ -0,0 +1,109 @@
+package maildir
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDir_Watch(t *testing.T) {
+	t.Parallel()
+
+	d := Dir(t.TempDir())
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events, err := d.Watch(ctx, 5*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testWatchEvents(t, d, events)
+
+	cancel()
+	for range events {
+	}
+}
+
+func TestDir_Watch_poll(t *testing.T) {
+	t.Parallel()
+
+	d := Dir(t.TempDir())
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events, err := d.watch(ctx, newPollBackend(5*time.Millisecond), 5*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testWatchEvents(t, d, events)
+
+	cancel()
+	for range events {
+	}
+}
+
+// testWatchEvents changes a message of d and checks the events reported on
+// events.
+func testWatchEvents(t *testing.T, d Dir, events <-chan WatchEvent) {
+	next := func(want WatchOp) WatchEvent {
+		t.Helper()
+		select {
+		case ev := <-events:
+			if ev.Err != nil {
+				t.Fatal(ev.Err)
+			}
+			if ev.Op != want {
+				t.Fatalf("event %v for %q, want %v", ev.Op, ev.Key, want)
+			}
+			return ev
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no %v event", want)
+		}
+		panic("unreachable")
+	}
+
+	key, err := d.Deliver(strings.NewReader("Subject: hello\r\n\r\n"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ev := next(WatchNew); ev.Key != key {
+		t.Errorf("new event for %q, want %q", ev.Key, key)
+	}
+	if _, err := d.Unseen(); err != nil {
+		t.Fatal(err)
+	}
+	if ev := next(WatchMoved); ev.Key != key || len(ev.Flags) != 0 {
+		t.Errorf("moved event %+v, want %q without flags", ev, key)
+	}
+	if err := d.SetFlags(key, []Flag{FlagSeen}); err != nil {
+		t.Fatal(err)
+	}
+	if ev := next(WatchFlags); ev.Key != key || string(flagsRunes(ev.Flags)) != "S" {
+		t.Errorf("flags event %+v, want %q with flags S", ev, key)
+	}
+	if err := d.Remove(key); err != nil {
+		t.Fatal(err)
+	}
+	if ev := next(WatchRemoved); ev.Key != key {
+		t.Errorf("removed event for %q, want %q", ev.Key, key)
+	}
+}
+
+func TestDir_Watch_invalidInterval(t *testing.T) {
+	t.Parallel()
+
+	d := Dir(t.TempDir())
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+	for _, interval := range []time.Duration{0, -time.Second} {
+		if _, err := d.Watch(context.Background(), interval); err == nil {
+			t.Errorf("Dir.Watch(%v) succeeded", interval)
+		}
+	}
+}